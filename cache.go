@@ -0,0 +1,159 @@
+// Result cache: with -cache=DIR, final results are stored in DIR keyed by
+// a fingerprint of the inputs, so repeated runs on the same inputs can
+// skip processing altogether
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	cacheVersion    = 1  // bump when the meaning of cached results changes
+	cacheSamples    = 16 // number of blocks hashed from each input
+	cacheSampleSize = 4096
+)
+
+// cacheDir is set by -cache.
+var cacheDir string
+
+// capturedResults is set by outputResults when captureResults is true, so
+// the final results of a run can be stored in the cache.
+var (
+	captureResults  bool
+	capturedResults []stationResult
+)
+
+// resultCacheKey returns the cache key for processing inputPaths with the
+// given options (anything that affects the results, like the revision).
+// Each input contributes its absolute path, size, modification time and a
+// hash of a sample of blocks spread through the file, which catches most
+// in-place rewrites that preserve the size and mtime without having to
+// read the whole file.
+func resultCacheKey(inputPaths []string, options string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "go-1brc cache v%d\n%s\n", cacheVersion, options)
+	for _, path := range inputPaths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		st, err := f.Stat()
+		if err == nil {
+			fmt.Fprintf(h, "%q %d %d\n", absPath, st.Size(), st.ModTime().UnixNano())
+			err = hashSamples(h, f, st.Size())
+		}
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashSamples writes cacheSamples blocks of the first size bytes of f,
+// evenly spaced from the start to the end, to h.
+func hashSamples(h hash.Hash, f io.ReaderAt, size int64) error {
+	buf := make([]byte, cacheSampleSize)
+	if size <= cacheSamples*cacheSampleSize {
+		_, err := io.Copy(h, io.NewSectionReader(f, 0, size))
+		return err
+	}
+	step := (size - cacheSampleSize) / (cacheSamples - 1)
+	for i := int64(0); i < cacheSamples; i++ {
+		_, err := f.ReadAt(buf, i*step)
+		if err != nil {
+			return err
+		}
+		h.Write(buf)
+		binary.Write(h, binary.LittleEndian, i*step)
+	}
+	return nil
+}
+
+func cacheEntryPath(key string) string {
+	return filepath.Join(cacheDir, key+".snap")
+}
+
+// readCache returns the cached results for key, if there are any.
+func readCache(key string) ([]stationResult, bool) {
+	results, _, err := readSnapshot(cacheEntryPath(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "warning: ignoring cache entry: %v\n", err)
+		}
+		return nil, false
+	}
+	return results, true
+}
+
+// writeCache stores results in the cache under key. If verify is true and
+// there's already an entry for key, it returns an error if the entry
+// doesn't match results (the entry is replaced either way).
+func writeCache(key string, results []stationResult, verify bool) error {
+	err := os.MkdirAll(cacheDir, 0o755)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = encodeSnapshot(&buf, sortedResults(results))
+	if err != nil {
+		return err
+	}
+
+	var mismatch bool
+	if verify {
+		cached, ok := readCache(key)
+		if ok {
+			var cachedBuf bytes.Buffer
+			err = encodeSnapshot(&cachedBuf, sortedResults(cached))
+			if err != nil {
+				return err
+			}
+			mismatch = !bytes.Equal(buf.Bytes(), cachedBuf.Bytes())
+			if !mismatch {
+				fmt.Fprintf(os.Stderr, "Cache entry %s verified\n", key)
+			}
+		}
+	}
+
+	err = writeFileAtomic(cacheEntryPath(key), func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if mismatch {
+		return fmt.Errorf("cache entry %s didn't match recomputed results (entry replaced)", key)
+	}
+	return nil
+}
+
+// sortedResults returns a copy of results sorted by station and then
+// window, so that equal results always encode the same way.
+func sortedResults(results []stationResult) []stationResult {
+	sorted := append([]stationResult(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].station != sorted[j].station {
+			return sorted[i].station < sorted[j].station
+		}
+		return sorted[i].window < sorted[j].window
+	})
+	return sorted
+}
@@ -0,0 +1,276 @@
+// Checkpointing: with -checkpoint=DIR, the parallel revisions save each
+// completed part to DIR so that an interrupted run can be resumed
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// checkpointDir is set by -checkpoint.
+var checkpointDir string
+
+// checkpointOptions describes the revision and the options that affect
+// the results, which must be the same to resume from a checkpoint.
+var checkpointOptions string
+
+// checkpointPartSize is the approximate size of each part when
+// checkpointing. Parts are only saved once complete, so they're kept
+// fairly small to limit the work lost when a run is interrupted.
+const checkpointPartSize = 64 * 1024 * 1024
+
+const checkpointManifestName = "manifest.json"
+
+// checkpointManifest records the inputs a checkpoint is for, the options
+// it was made with, and how the inputs were split into parts. Part i's results are saved in the snapshot format
+// to partFileName(i) once it's complete.
+type checkpointManifest struct {
+	Inputs  []checkpointInput `json:"inputs"`
+	Options string            `json:"options"`
+	Parts   []checkpointPart  `json:"parts"`
+}
+
+type checkpointInput struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type checkpointPart struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+func partFileName(i int) string {
+	return fmt.Sprintf("part-%05d.snap", i)
+}
+
+// checkpoint is the state of a checkpointed run: the parts the input is
+// split into and the merged results of the parts completed so far.
+type checkpoint struct {
+	dir     string
+	parts   []part
+	done    []bool
+	totals  map[string]map[string]*stationResult // per input path
+	covered []byteRange
+}
+
+// openCheckpoint loads the checkpoint in dir, or starts a new one if
+// there isn't one yet. It's an error if the checkpoint is for different
+// inputs or options, or if the inputs have changed since it was written.
+func openCheckpoint(dir string, inputPaths []string) (*checkpoint, error) {
+	var inputs []checkpointInput
+	var total int64
+	for _, path := range inputPaths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, checkpointInput{path, st.Size(), st.ModTime()})
+		total += st.Size()
+	}
+
+	c := &checkpoint{
+		dir:    dir,
+		totals: make(map[string]map[string]*stationResult),
+	}
+	manifestPath := filepath.Join(dir, checkpointManifestName)
+	data, err := os.ReadFile(manifestPath)
+	switch {
+	case err == nil:
+		var manifest checkpointManifest
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", manifestPath, err)
+		}
+		if !slices.EqualFunc(manifest.Inputs, inputs, func(a, b checkpointInput) bool {
+			return a.Path == b.Path && a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+		}) {
+			return nil, fmt.Errorf("checkpoint in %s is for different or modified input (remove it to start over)", dir)
+		}
+		if manifest.Options != checkpointOptions {
+			return nil, fmt.Errorf("checkpoint in %s was made with a different revision or options (remove it to start over)", dir)
+		}
+		for _, p := range manifest.Parts {
+			c.parts = append(c.parts, part{p.Path, p.Offset, p.Size})
+		}
+
+	case errors.Is(err, fs.ErrNotExist):
+		err = os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+		numParts := max(maxGoroutines, int(total/checkpointPartSize))
+		c.parts, err = splitFiles(inputPaths, numParts)
+		if err != nil {
+			return nil, err
+		}
+		manifest := checkpointManifest{Inputs: inputs, Options: checkpointOptions}
+		for _, p := range c.parts {
+			manifest.Parts = append(manifest.Parts, checkpointPart{p.path, p.offset, p.size})
+		}
+		err = writeFileAtomic(manifestPath, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(manifest)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, err
+	}
+
+	// Load the parts that were completed by a previous run.
+	c.done = make([]bool, len(c.parts))
+	for i, p := range c.parts {
+		results, _, err := readSnapshot(filepath.Join(dir, partFileName(i)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: reprocessing part: %v\n", err)
+			continue
+		}
+		c.merge(p.path, results)
+		c.covered = append(c.covered, byteRange{p.path, p.offset, p.offset + p.size})
+		c.done[i] = true
+	}
+	return c, nil
+}
+
+func (c *checkpoint) merge(path string, results []stationResult) {
+	if c.totals[path] == nil {
+		c.totals[path] = make(map[string]*stationResult)
+	}
+	mergeResults(c.totals[path], results)
+}
+
+// todo returns the indexes of the parts that haven't been completed.
+func (c *checkpoint) todo() []int {
+	var indexes []int
+	for i, done := range c.done {
+		if !done {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// save records the results of part i, which is complete.
+func (c *checkpoint) save(i int, results []stationResult) error {
+	err := writeFileAtomic(filepath.Join(c.dir, partFileName(i)), func(w io.Writer) error {
+		return encodeSnapshot(w, results)
+	})
+	if err != nil {
+		return err
+	}
+	c.done[i] = true
+	return nil
+}
+
+// results returns the merged results for the file at path, or for all
+// input files if path is "".
+func (c *checkpoint) results(path string) []stationResult {
+	if path != "" {
+		return resultsSlice(c.totals[path])
+	}
+	totals := make(map[string]*stationResult)
+	for _, fileTotals := range c.totals {
+		mergeResults(totals, resultsSlice(fileTotals))
+	}
+	return resultsSlice(totals)
+}
+
+// remove deletes the checkpoint's files once the run is complete.
+func (c *checkpoint) remove() error {
+	for i := range c.parts {
+		err := os.Remove(filepath.Join(c.dir, partFileName(i)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Remove(filepath.Join(c.dir, checkpointManifestName))
+}
+
+// runCheckpointed is used by the parallel revisions instead of their
+// usual split/process/merge when -checkpoint is set. Parts completed by
+// an earlier run are skipped, and each part is saved as soon as it's
+// done. All parts, saved or new, are merged as fixed point stationResults
+// so the output is the same however many times the run was resumed.
+func runCheckpointed[S any](
+	ctx context.Context,
+	inputPaths []string,
+	output io.Writer,
+	processPart func(p part, resultsCh chan partResult[S]),
+	toResults func(stats map[string]S) []stationResult,
+) error {
+	mark := time.Now()
+	c, err := openCheckpoint(checkpointDir, inputPaths)
+	if err != nil {
+		return err
+	}
+	timings.record(phaseSplit, mark)
+
+	// Parts are identified by where they start, as the end of the covered
+	// range may be past the end of a file with no final newline.
+	type partStart struct {
+		path   string
+		offset int64
+	}
+	todo := c.todo()
+	index := make(map[partStart]int, len(todo))
+	parts := make([]part, len(todo))
+	for j, i := range todo {
+		parts[j] = c.parts[i]
+		index[partStart{c.parts[i].path, c.parts[i].offset}] = i
+	}
+
+	resultsCh := make(chan partResult[S])
+	runParts(parts, func(p part) {
+		processPart(p, resultsCh)
+	})
+
+	covered := c.covered
+	stopped := false
+	var saveErr error
+	for range parts {
+		result := <-resultsCh
+		mergeStart := time.Now()
+		covered = append(covered, result.covered)
+		stopped = stopped || result.stopped
+		results := toResults(result.stats)
+		c.merge(result.covered.path, results)
+		if !result.stopped && saveErr == nil {
+			saveErr = c.save(index[partStart{result.covered.path, result.covered.start}], results)
+		}
+		timings.record(phaseMerge, mergeStart)
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+
+	if perFile {
+		for _, path := range inputPaths {
+			fmt.Fprintf(output, "%s: ", path)
+			writeResults(output, c.results(path), outputFormat)
+		}
+	}
+	err = outputResults(output, c.results(""))
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), covered}
+	}
+	return c.remove()
+}
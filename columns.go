@@ -0,0 +1,101 @@
+// Multiple value columns: with -columns=temp,humidity,..., each line has
+// a value for every column (station;temp;humidity;...) and r10 aggregates
+// them all in one pass
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// valueColumns is set by -columns to the names of the value columns. If
+// there's more than one, the stats for the columns after the first are
+// kept in the cols field of r10Stats and stationResult.
+var valueColumns []string
+
+// columnStats are the stats for one extra value column. The count is the
+// same as the station's, as every line has a value for every column.
+type columnStats struct {
+	min, max int32
+	sum      int64
+}
+
+// newColumns returns stats for a station's first line with the given
+// extra column values.
+func newColumns(values []int32) []columnStats {
+	cols := make([]columnStats, len(values))
+	for i, v := range values {
+		cols[i] = columnStats{v, v, int64(v)}
+	}
+	return cols
+}
+
+// addColumns adds a line's extra column values to cols.
+func addColumns(cols []columnStats, values []int32) {
+	for i, v := range values {
+		c := &cols[i]
+		c.min = min(c.min, v)
+		c.max = max(c.max, v)
+		c.sum += int64(v)
+	}
+}
+
+// mergeColumns adds the stats in src to dst, returning dst (or a copy of
+// src if dst is nil).
+func mergeColumns(dst, src []columnStats) []columnStats {
+	if dst == nil {
+		return append([]columnStats(nil), src...)
+	}
+	for i, s := range src {
+		c := &dst[i]
+		c.min = min(c.min, s.min)
+		c.max = max(c.max, s.max)
+		c.sum += s.sum
+	}
+	return dst
+}
+
+// parseColumns parses the extra column values after the first, like
+// ";55.0;1013.2", from the start of b into values, as fixed point tenths.
+// Unlike temperatures, they may have any number of integer digits and
+// the decimal part is optional. It returns the number of bytes consumed,
+// which doesn't include the final newline.
+func parseColumns(b []byte, values []int32) int {
+	index := 0
+	for i := range values {
+		if b[index] != ';' {
+			panic(fmt.Sprintf("expected %d value columns, got %d", len(values)+1, i+1))
+		}
+		index++
+		negative := false
+		if b[index] == '-' {
+			negative = true
+			index++
+		}
+		var v int32
+		for b[index] >= '0' && b[index] <= '9' {
+			v = v*10 + int32(b[index]-'0')
+			index++
+		}
+		v *= 10
+		if b[index] == '.' {
+			v += int32(b[index+1] - '0')
+			index += 2
+		}
+		if negative {
+			v = -v
+		}
+		values[i] = v
+	}
+	return index
+}
+
+// columnName returns the name of extra column i (0 is the one after the
+// first value column).
+func columnName(i int) string {
+	if i+1 < len(valueColumns) {
+		return valueColumns[i+1]
+	}
+	return strconv.Itoa(i + 2)
+}
@@ -0,0 +1,285 @@
+// Distributed mode: "go-1brc coordinator" splits the input into byte
+// ranges and hands them out to "go-1brc worker" processes over net/rpc.
+// The input path must be readable by every worker at the same path.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Worker is the RPC service run by "go-1brc worker".
+type Worker struct{}
+
+// RangeArgs are the arguments to Worker.Process: the byte range of the
+// file to aggregate, which must start and end on line boundaries.
+type RangeArgs struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+// RangeReply is the result of Worker.Process. The stats are sent in the
+// snapshot format so the coordinator can merge them like any snapshot.
+type RangeReply struct {
+	Snapshot []byte
+}
+
+// Process aggregates a byte range of a file using r10's parser. A
+// malformed line makes the parser panic, which is returned as an error
+// rather than taking down the worker.
+func (w *Worker) Process(args RangeArgs, reply *RangeReply) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s at offset %d: malformed input: %v", args.Path, args.Offset, r)
+		}
+	}()
+	f, err := openPart(args.Path, args.Offset, args.Size)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stats, _, err := r10ProcessReader(context.Background(), f)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = encodeSnapshot(&buf, r10Results(stats))
+	if err != nil {
+		return err
+	}
+	reply.Snapshot = buf.Bytes()
+	return nil
+}
+
+func runWorker(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:9001", "address to listen on for the coordinator")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: go-1brc worker [options]\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	server := rpc.NewServer()
+	err := server.Register(&Worker{})
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	log.Printf("worker listening on %s", *addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+func runCoordinator(args []string) error {
+	flags := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	var (
+		workers     = flags.String("workers", "", "comma-separated list of worker addresses")
+		partsPer    = flags.Int("parts", 8, "number of byte ranges to split the input into, per worker")
+		concurrency = flags.Int("concurrency", 1, "ranges to process at once on each worker")
+		retries     = flags.Int("retries", 3, "times to retry a failed range before giving up")
+		callTimeout = flags.Duration("calltimeout", 10*time.Minute, "time to wait for a worker to process one range")
+		format      = flags.String("format", "text", "output format: "+strings.Join(outputFormats, ", "))
+		snapshot    = flags.String("snapshot", "", "also write the final results to this snapshot file")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: go-1brc coordinator -workers=ADDR,... [options] INPUT...\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *workers == "" || flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if !slices.Contains(outputFormats, *format) {
+		return fmt.Errorf("invalid format %q", *format)
+	}
+	outputFormat = *format
+	snapshotPath = *snapshot
+
+	inputPaths, err := expandInputs(flags.Args())
+	if err != nil {
+		return err
+	}
+	addrs := strings.Split(*workers, ",")
+	parts, err := splitFiles(inputPaths, len(addrs)**partsPer)
+	if err != nil {
+		return err
+	}
+
+	c := &coordinator{
+		addrs:       addrs,
+		concurrency: *concurrency,
+		retries:     *retries,
+		callTimeout: *callTimeout,
+	}
+	results, err := c.run(parts)
+	if err != nil {
+		return err
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+	return outputResults(output, results)
+}
+
+// coordinator hands out parts to workers and merges the results.
+type coordinator struct {
+	addrs       []string
+	concurrency int
+	retries     int
+	callTimeout time.Duration
+}
+
+type rangeTask struct {
+	part     part
+	attempts int
+}
+
+type rangeResult struct {
+	task    rangeTask
+	results []stationResult
+	err     error
+}
+
+// run processes all parts on the workers. A range that fails (because the
+// worker returned an error, timed out, or went away) is put back on the
+// queue for any worker to retry, up to c.retries times. A worker whose
+// connection fails is dropped; run fails if every worker is dropped
+// before all ranges are done.
+func (c *coordinator) run(parts []part) ([]stationResult, error) {
+	tasks := make(chan rangeTask, len(parts))
+	for _, p := range parts {
+		tasks <- rangeTask{part: p}
+	}
+	resultsCh := make(chan rangeResult)
+	exited := make(chan string, len(c.addrs)*c.concurrency)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	numRunners := 0
+	for _, addr := range c.addrs {
+		for i := 0; i < c.concurrency; i++ {
+			numRunners++
+			go func(addr string) {
+				err := c.runWorkerConn(ctx, addr, tasks, resultsCh)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("dropping worker %s: %v", addr, err)
+				}
+				exited <- addr
+			}(addr)
+		}
+	}
+
+	totals := make(map[string]*stationResult)
+	pending := len(parts)
+	for pending > 0 {
+		select {
+		case result := <-resultsCh:
+			if result.err != nil {
+				result.task.attempts++
+				if result.task.attempts > c.retries {
+					return nil, fmt.Errorf("range %s:%d+%d failed after %d attempts: %w",
+						result.task.part.path, result.task.part.offset, result.task.part.size,
+						result.task.attempts, result.err)
+				}
+				log.Printf("retrying range %s:%d+%d: %v", result.task.part.path,
+					result.task.part.offset, result.task.part.size, result.err)
+				tasks <- result.task
+				continue
+			}
+			mergeResults(totals, result.results)
+			pending--
+		case <-exited:
+			numRunners--
+			if numRunners == 0 {
+				return nil, errors.New("all workers failed")
+			}
+		}
+	}
+	return resultsSlice(totals), nil
+}
+
+// runWorkerConn connects to the worker at addr and sends it tasks until
+// the queue is closed or ctx is done. It returns an error if the
+// connection fails.
+func (c *coordinator) runWorkerConn(ctx context.Context, addr string, tasks chan rangeTask, resultsCh chan<- rangeResult) error {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		var task rangeTask
+		select {
+		case task = <-tasks:
+		case <-ctx.Done():
+			return nil
+		}
+
+		args := RangeArgs{task.part.path, task.part.offset, task.part.size}
+		var reply RangeReply
+		call := client.Go("Worker.Process", args, &reply, nil)
+		var callErr error
+		select {
+		case <-call.Done:
+			callErr = call.Error
+		case <-time.After(c.callTimeout):
+			callErr = errors.New("timed out")
+		case <-ctx.Done():
+			return nil
+		}
+
+		var results []stationResult
+		if callErr == nil {
+			results, _, callErr = decodeSnapshot(reply.Snapshot)
+		}
+		select {
+		case resultsCh <- rangeResult{task, results, callErr}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		var serverErr rpc.ServerError
+		if callErr != nil && !errors.As(callErr, &serverErr) {
+			// Not an error from Worker.Process, so the connection is bad.
+			return callErr
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Input encodings: a UTF-8 byte order mark is skipped, and UTF-16 input is
+// transcoded to UTF-8 as it's read, so the parsers only ever see UTF-8
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// inputEncoding is how an input file is encoded, as found by
+// detectEncoding.
+type inputEncoding struct {
+	bom   int64            // length of the byte order mark, if any
+	order binary.ByteOrder // byte order for UTF-16, or nil for UTF-8
+}
+
+// encodingSampleSize is how much of the start of a file detectEncoding
+// looks at when there's no byte order mark.
+const encodingSampleSize = 512
+
+// detectEncoding looks at the start of the file to find its encoding. A
+// byte order mark is used if there is one; otherwise NUL bytes (which
+// never appear in the text this program reads) in every other position
+// mean UTF-16 without one. It returns an error for other encodings.
+func detectEncoding(f io.ReaderAt, size int64) (inputEncoding, error) {
+	buf := make([]byte, min(size, encodingSampleSize))
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return inputEncoding{}, err
+	}
+	buf = buf[:n]
+
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xFF, 0xFE, 0, 0}) || bytes.HasPrefix(buf, []byte{0, 0, 0xFE, 0xFF}):
+		return inputEncoding{}, errors.New("unsupported encoding UTF-32 (only UTF-8 and UTF-16 are supported)")
+	case bytes.HasPrefix(buf, []byte{0xEF, 0xBB, 0xBF}):
+		return inputEncoding{bom: 3}, nil
+	case bytes.HasPrefix(buf, []byte{0xFF, 0xFE}):
+		return inputEncoding{bom: 2, order: binary.LittleEndian}, nil
+	case bytes.HasPrefix(buf, []byte{0xFE, 0xFF}):
+		return inputEncoding{bom: 2, order: binary.BigEndian}, nil
+	}
+
+	if bytes.IndexByte(buf, 0) < 0 {
+		return inputEncoding{}, nil
+	}
+	var evenNUL, oddNUL int
+	for i, c := range buf {
+		if c == 0 && i%2 == 0 {
+			evenNUL++
+		} else if c == 0 {
+			oddNUL++
+		}
+	}
+	switch {
+	case evenNUL == 0:
+		return inputEncoding{order: binary.LittleEndian}, nil
+	case oddNUL == 0:
+		return inputEncoding{order: binary.BigEndian}, nil
+	}
+	return inputEncoding{}, errors.New("unsupported encoding (input contains NUL bytes but isn't UTF-16)")
+}
+
+// openEncoding opens an input file and detects its encoding, returning
+// the file and its size. The error includes the path.
+func openEncoding(path string) (*os.File, int64, inputEncoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, inputEncoding{}, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, inputEncoding{}, err
+	}
+	enc, err := detectEncoding(f, st.Size())
+	if err != nil {
+		f.Close()
+		return nil, 0, inputEncoding{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, st.Size(), enc, nil
+}
+
+// newline returns the encoded form of '\n'.
+func (e inputEncoding) newline() []byte {
+	switch e.order {
+	case binary.LittleEndian:
+		return []byte{'\n', 0}
+	case binary.BigEndian:
+		return []byte{0, '\n'}
+	default:
+		return []byte{'\n'}
+	}
+}
+
+// lastNewline returns the index in chunk of the end of the last encoded
+// newline (the index of the byte after it), or -1 if there isn't one.
+// chunk starts at the given file offset, which UTF-16 needs so that only
+// newlines aligned to a code unit are found.
+func (e inputEncoding) lastNewline(chunk []byte, offset int64) int {
+	nl := e.newline()
+	for end := len(chunk); ; {
+		i := bytes.LastIndex(chunk[:end], nl)
+		if i < 0 {
+			return -1
+		}
+		if (offset+int64(i)-e.bom)%int64(len(nl)) == 0 {
+			return i + len(nl)
+		}
+		end = i + len(nl) - 1
+	}
+}
+
+// reader returns a reader of r's text as UTF-8, where r reads the encoded
+// text (after any byte order mark).
+func (e inputEncoding) reader(r io.Reader) io.Reader {
+	if e.order == nil {
+		return r
+	}
+	return &utf16Reader{src: r, order: e.order, buf: make([]byte, 0, 64*1024)}
+}
+
+// span returns how many bytes of the encoded text in f, starting at
+// offset and at most size bytes long, make up the first n bytes of its
+// UTF-8 text (or all of it if it's shorter), and how long that text is.
+// For UTF-16 it decodes the text again to find out, so it's only meant for
+// reporting how far a cancelled run got.
+func (e inputEncoding) span(f io.ReaderAt, offset, size, n int64) (raw, text int64) {
+	if e.order == nil {
+		n = min(n, size)
+		return n, n
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size))
+	unit := make([]byte, 2)
+	for text < n {
+		_, err := io.ReadFull(r, unit)
+		if err != nil {
+			break
+		}
+		raw += 2
+		c := rune(e.order.Uint16(unit))
+		if utf16.IsSurrogate(c) {
+			c = utf8.RuneError // unless it's a valid pair
+			next, err := r.Peek(2)
+			if err == nil {
+				if d := utf16.DecodeRune(rune(e.order.Uint16(unit)), rune(e.order.Uint16(next))); d != utf8.RuneError {
+					r.Discard(2)
+					raw += 2
+					c = d
+				}
+			}
+		}
+		text += int64(utf8.RuneLen(c))
+	}
+	return raw, text
+}
+
+// utf16Reader transcodes UTF-16 text read from src to UTF-8. Invalid
+// UTF-16 (lone surrogates) is replaced by U+FFFD, as is an odd byte at
+// the end.
+type utf16Reader struct {
+	src     io.Reader
+	order   binary.ByteOrder
+	buf     []byte // encoded bytes read from src but not yet decoded
+	pos     int    // start of the undecoded bytes in buf
+	eof     bool
+	pending []byte // rest of a decoded rune that didn't fit in p
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	for n < len(p) {
+		if len(u.buf)-u.pos < 4 && !u.eof {
+			u.buf = u.buf[:copy(u.buf, u.buf[u.pos:])]
+			u.pos = 0
+			m, err := u.src.Read(u.buf[len(u.buf):cap(u.buf)])
+			u.buf = u.buf[:len(u.buf)+m]
+			if err == io.EOF {
+				u.eof = true
+			} else if err != nil {
+				return n, err
+			}
+			if m == 0 && !u.eof {
+				break
+			}
+			continue
+		}
+		avail := u.buf[u.pos:]
+		if len(avail) == 0 {
+			break
+		}
+		c := utf8.RuneError
+		size := len(avail) // an odd byte at the end
+		if len(avail) >= 2 {
+			c = rune(u.order.Uint16(avail))
+			size = 2
+		}
+		if utf16.IsSurrogate(c) {
+			c = utf8.RuneError
+			if len(avail) >= 4 {
+				if d := utf16.DecodeRune(rune(u.order.Uint16(avail)), rune(u.order.Uint16(avail[2:]))); d != utf8.RuneError {
+					c = d
+					size = 4
+				}
+			}
+		}
+		u.pos += size
+		if len(p)-n >= utf8.UTFMax {
+			n += utf8.EncodeRune(p[n:], c)
+			continue
+		}
+		var enc [utf8.UTFMax]byte
+		m := copy(p[n:], enc[:utf8.EncodeRune(enc[:], c)])
+		u.pending = append(u.pending[:0], enc[m:utf8.RuneLen(c)]...)
+		n += m
+	}
+	if n == 0 && u.eof && u.pos == len(u.buf) {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// partReader reads the text of a part of an input file as UTF-8, for the
+// parallel revisions' workers.
+type partReader struct {
+	file         *os.File
+	r            io.Reader
+	enc          inputEncoding
+	offset, size int64
+}
+
+// openPart opens the part of the file at path that starts at offset and
+// is size bytes long.
+func openPart(path string, offset, size int64) (*partReader, error) {
+	file, _, enc, err := openEncoding(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := enc.reader(progressReader{&io.LimitedReader{R: file, N: size}})
+	return &partReader{file, r, enc, offset, size}, nil
+}
+
+func (p *partReader) Read(buf []byte) (int, error) {
+	return p.r.Read(buf)
+}
+
+func (p *partReader) Close() error {
+	return p.file.Close()
+}
+
+// end returns the file offset just after the first processed bytes of
+// the part's text.
+func (p *partReader) end(processed int64) int64 {
+	raw, _ := p.enc.span(p.file, p.offset, p.size, processed)
+	return p.offset + raw
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    inputEncoding
+		wantErr bool
+	}{
+		{"Foo;1.0\n", inputEncoding{}, false},
+		{"", inputEncoding{}, false},
+		{"\xEF\xBB\xBFFoo;1.0\n", inputEncoding{bom: 3}, false},
+		{"\xFF\xFEF\x00o\x00", inputEncoding{bom: 2, order: binary.LittleEndian}, false},
+		{"\xFE\xFF\x00F\x00o", inputEncoding{bom: 2, order: binary.BigEndian}, false},
+		{"F\x00o\x00o\x00", inputEncoding{order: binary.LittleEndian}, false},
+		{"\x00F\x00o\x00o", inputEncoding{order: binary.BigEndian}, false},
+		{"\xFF\xFE\x00\x00F\x00\x00\x00", inputEncoding{}, true},
+		{"\x00\x00\xFE\xFF\x00\x00\x00F", inputEncoding{}, true},
+		{"F\x00\x00o", inputEncoding{}, true},
+	}
+	for _, test := range tests {
+		got, err := detectEncoding(bytes.NewReader([]byte(test.input)), int64(len(test.input)))
+		if (err != nil) != test.wantErr {
+			t.Errorf("detectEncoding(%q): want error %v, got %v", test.input, test.wantErr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("detectEncoding(%q): want %+v, got %+v", test.input, test.want, got)
+		}
+	}
+}
+
+func TestLastNewline(t *testing.T) {
+	le := inputEncoding{order: binary.LittleEndian}
+	leBOM := inputEncoding{bom: 2, order: binary.LittleEndian}
+	be := inputEncoding{order: binary.BigEndian}
+	tests := []struct {
+		enc    inputEncoding
+		chunk  string
+		offset int64
+		want   int
+	}{
+		{inputEncoding{}, "a\nb\n", 0, 4},
+		{inputEncoding{}, "a\nb", 7, 2},
+		{inputEncoding{}, "ab", 0, -1},
+		{le, "a\x00\n\x00b\x00", 0, 4},
+		{le, "A\n\x00A", 0, -1}, // U+0A41 U+4100: "\n\x00" isn't on a code unit
+		{le, "\n\x00A\n\x00A", 0, 2},
+		{le, "\n\x00A", 1, -1},
+		{le, "\x00\n\x00", 1, 3},
+		{leBOM, "a\x00\n\x00", 2, 4},
+		{leBOM, "\x00\n\x00", 3, 3},
+		{leBOM, "\n\x00a\x00", 3, -1},
+		{be, "\x00a\x00\n", 0, 4},
+		{be, "\x00\n\x00", 1, -1},
+	}
+	for _, test := range tests {
+		got := test.enc.lastNewline([]byte(test.chunk), test.offset)
+		if got != test.want {
+			t.Errorf("lastNewline(%q, %d) with %+v: want %d, got %d",
+				test.chunk, test.offset, test.enc, test.want, got)
+		}
+	}
+}
+
+func TestUTF16Reader(t *testing.T) {
+	// "a😀b\n", where U+1F600 is the surrogate pair D83D DE00.
+	const le = "a\x00\x3D\xD8\x00\xDEb\x00\n\x00"
+	const be = "\x00a\xD8\x3D\xDE\x00\x00b\x00\n"
+	tests := []struct {
+		name    string
+		order   binary.ByteOrder
+		input   string
+		oneByte bool // read the input a byte at a time, splitting the pair
+		bufSize int  // size of each Read, to split the UTF-8 output
+		want    string
+	}{
+		{"little-endian", binary.LittleEndian, le, false, 64, "a😀b\n"},
+		{"big-endian", binary.BigEndian, be, false, 64, "a😀b\n"},
+		{"pair split across reads", binary.LittleEndian, le, true, 64, "a😀b\n"},
+		{"rune split across reads", binary.LittleEndian, le, false, 3, "a😀b\n"},
+		{"one byte at a time", binary.BigEndian, be, true, 1, "a😀b\n"},
+		{"lone surrogate", binary.LittleEndian, "\x3D\xD8a\x00", true, 2, "�a"},
+		{"odd byte at end", binary.LittleEndian, "a\x00b", false, 64, "a�"},
+	}
+	for _, test := range tests {
+		var src io.Reader = bytes.NewReader([]byte(test.input))
+		if test.oneByte {
+			src = iotest.OneByteReader(src)
+		}
+		r := inputEncoding{order: test.order}.reader(src)
+		var got []byte
+		buf := make([]byte, test.bufSize)
+		for {
+			n, err := r.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: read failed: %v", test.name, err)
+			}
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: want %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSpan(t *testing.T) {
+	// "a😀b\n" as UTF-16: 10 bytes of which the emoji is 4, and 7 bytes of
+	// UTF-8 of which the emoji is 4.
+	utf16LE := bytes.NewReader([]byte("a\x00\x3D\xD8\x00\xDEb\x00\n\x00"))
+	utf8 := bytes.NewReader([]byte("a😀b\n"))
+	le := inputEncoding{order: binary.LittleEndian}
+	tests := []struct {
+		enc               inputEncoding
+		f                 io.ReaderAt
+		offset, size, n   int64
+		wantRaw, wantText int64
+	}{
+		{inputEncoding{}, utf8, 0, 7, 3, 3, 3},
+		{inputEncoding{}, utf8, 0, 7, 20, 7, 7},
+		{le, utf16LE, 0, 10, 0, 0, 0},
+		{le, utf16LE, 0, 10, 1, 2, 1},
+		{le, utf16LE, 0, 10, 2, 6, 5}, // the whole rune, not half of it
+		{le, utf16LE, 0, 10, 5, 6, 5},
+		{le, utf16LE, 0, 10, 100, 10, 7},
+		{le, utf16LE, 2, 8, 4, 4, 4},
+		{le, utf16LE, 2, 2, 4, 2, 3}, // lone high surrogate at the end
+	}
+	for _, test := range tests {
+		raw, text := test.enc.span(test.f, test.offset, test.size, test.n)
+		if raw != test.wantRaw || text != test.wantText {
+			t.Errorf("span(%d, %d, %d) with %+v: want %d, %d, got %d, %d",
+				test.offset, test.size, test.n, test.enc, test.wantRaw, test.wantText, raw, text)
+		}
+	}
+}
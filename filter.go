@@ -0,0 +1,126 @@
+// Station filtering: -station, -prefix and -match limit the output to
+// matching stations
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// stationFilter is set from -station, -prefix and -match. If it's not nil,
+// only stations it returns true for are output. r9 and r10 also skip
+// aggregating other stations, calling it once per distinct station when
+// it's added to their hash table; the other revisions are filtered in the
+// output stage.
+var stationFilter func(station string) bool
+
+// newStationFilter returns a filter that matches stations that pass all
+// of the given filters, or nil if none are given. stations is a
+// comma-separated list of exact names, or "@FILE" to read names from a
+// file, one per line; prefix matches names starting with it; and match is
+// a regular expression that must match somewhere in the name.
+func newStationFilter(stations, prefix, match string) (func(string) bool, error) {
+	var filters []func(string) bool
+
+	if stations != "" {
+		names, err := readStationList(stations)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]bool, len(names))
+		for _, name := range names {
+			set[name] = true
+		}
+		filters = append(filters, func(station string) bool {
+			return set[station]
+		})
+	}
+
+	if prefix != "" {
+		filters = append(filters, func(station string) bool {
+			return strings.HasPrefix(station, prefix)
+		})
+	}
+
+	if match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, re.MatchString)
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return func(station string) bool {
+		for _, filter := range filters {
+			if !filter(station) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// readStationList returns the names in a -station value: a
+// comma-separated list, or "@FILE" to read them from a file, one per line.
+func readStationList(stations string) ([]string, error) {
+	path, ok := strings.CutPrefix(stations, "@")
+	if !ok {
+		return strings.Split(stations, ","), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			names = append(names, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// stationListKey returns a checksum of the set of names in a -station
+// value, for the result cache and -incremental state. Using the names
+// rather than the value itself means editing an @FILE is noticed.
+func stationListKey(stations string) (string, error) {
+	if stations == "" {
+		return "", nil
+	}
+	names, err := readStationList(stations)
+	if err != nil {
+		return "", err
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// filterResults returns the results for stations that pass stationFilter.
+func filterResults(results []stationResult) []stationResult {
+	if stationFilter == nil {
+		return results
+	}
+	var filtered []stationResult
+	for _, r := range results {
+		if stationFilter(r.station) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,156 @@
+// Follow mode: keep aggregating lines as they're appended to a file
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// followFile processes the existing content of inputPath with r10's
+// parallel path, then polls the file every interval for newly appended
+// lines. After the initial pass and whenever new lines have been added,
+// it writes the updated aggregates to output, or replaces the file at
+// outPath if that's set. It returns when ctx is cancelled.
+func followFile(ctx context.Context, inputPath string, output io.Writer, outPath string, interval time.Duration) error {
+	f, _, enc, err := openEncoding(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if enc.order != nil {
+		return fmt.Errorf("%s: -follow doesn't support UTF-16 input", inputPath)
+	}
+
+	res, err := r10Aggregate(ctx, []string{inputPath})
+	if err != nil {
+		return err
+	}
+	if res.stopped {
+		return &incompleteError{ctx.Err(), res.covered}
+	}
+	totals := res.totals
+
+	// The parts cover everything up to the end of the last complete line,
+	// so carry on from there.
+	var offset int64
+	for _, r := range res.covered {
+		offset = max(offset, r.end)
+	}
+
+	emit := func() error {
+		if outPath == "" {
+			writeResults(output, r10Results(totals), outputFormat)
+			if w, ok := output.(*bufio.Writer); ok {
+				return w.Flush()
+			}
+			return nil
+		}
+		return writeFileAtomic(outPath, func(w io.Writer) error {
+			writeResults(w, r10Results(totals), outputFormat)
+			return nil
+		})
+	}
+	err = emit()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	buf := make([]byte, 1024*1024)
+	readStart := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if st.Size() < offset+int64(readStart) {
+			return fmt.Errorf("%s was truncated from %d to %d bytes",
+				inputPath, offset+int64(readStart), st.Size())
+		}
+
+		changed := false
+		for {
+			n, err := f.ReadAt(buf[readStart:], offset+int64(readStart))
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			chunk := buf[:readStart+n]
+
+			newline := bytes.LastIndexByte(chunk, '\n')
+			if newline < 0 {
+				if len(chunk) == len(buf) {
+					return fmt.Errorf("line too long at offset %d", offset)
+				}
+				readStart = len(chunk) // partial line, wait for the rest
+				break
+			}
+			remaining := chunk[newline+1:]
+			chunk = chunk[:newline+1]
+
+			stats, _, err := r10ProcessReader(ctx, bytes.NewReader(chunk))
+			if err != nil {
+				return nil // cancelled, don't merge a partial chunk
+			}
+			r10Merge(totals, stats)
+			offset += int64(len(chunk))
+			changed = true
+
+			readStart = copy(buf, remaining)
+		}
+
+		if changed {
+			err := emit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeFileAtomic writes a file by calling write with a temporary file in
+// the same directory and then renaming it over path, so readers never see
+// a partly-written file.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Chmod(0o644)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
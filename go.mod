@@ -1,3 +1,5 @@
 module github.com/benhoyt/go-1brc
 
 go 1.21.0
+
+require golang.org/x/text v0.14.0
@@ -0,0 +1,88 @@
+// Hierarchical grouping: -groupby rolls station results up to a key
+// derived from the station name, such as the country in "Country/City"
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// groupKey and groupLeaves are set by -groupby and -leaves. If groupKey
+// is not nil, writeResults combines the results of stations with the same
+// key, and if groupLeaves is true it also writes each group's stations.
+var (
+	groupKey    func(station string) string
+	groupLeaves bool
+)
+
+// parseGroupBy parses a -groupby spec, which is one of:
+//
+//   - "prefix:N": the first N characters of the name
+//   - "split:SEP:N": the first N fields of the name split on SEP, for
+//     example "split:/:1" groups "Country/City" by country
+func parseGroupBy(spec string) (func(string) string, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "prefix":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid -groupby %q: N must be a positive integer", spec)
+		}
+		return func(station string) string {
+			i := 0
+			for j := 0; j < n && i < len(station); j++ {
+				_, size := utf8.DecodeRuneInString(station[i:])
+				i += size
+			}
+			return station[:i]
+		}, nil
+
+	case "split":
+		colon := strings.LastIndexByte(arg, ':')
+		if colon <= 0 {
+			return nil, fmt.Errorf("invalid -groupby %q: expected split:SEP:N", spec)
+		}
+		sep := arg[:colon]
+		n, err := strconv.Atoi(arg[colon+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid -groupby %q: N must be a positive integer", spec)
+		}
+		return func(station string) string {
+			i := 0
+			for j := 0; j < n; j++ {
+				next := strings.Index(station[i:], sep)
+				if next < 0 {
+					return station
+				}
+				if j < n-1 {
+					i += next + len(sep)
+				} else {
+					i += next
+				}
+			}
+			return station[:i]
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid -groupby %q: must be prefix:N or split:SEP:N", spec)
+	}
+}
+
+// groupResults combines results by groupKey, which is called once per
+// station (rather than per row, as the results are already merged). It
+// returns the combined results and the stations in each group.
+func groupResults(results []stationResult) ([]stationResult, map[string][]stationResult) {
+	totals := make(map[string]*stationResult)
+	leaves := make(map[string][]stationResult)
+	for _, r := range results {
+		key := groupKey(r.station)
+		leaves[key] = append(leaves[key], r)
+		g := r
+		g.station = key
+		mergeResults(totals, []stationResult{g})
+	}
+	return resultsSlice(totals), leaves
+}
@@ -0,0 +1,316 @@
+// Incremental mode: with -incremental=STATE, keep the aggregates for a
+// growing file in STATE and only process what's been appended since the
+// last run
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// incrementalState is what's saved between incremental runs: the stats
+// for the first Offset bytes of Path (which end on a line boundary),
+// checksums of those bytes to detect the file being rewritten, and the
+// options that affected the stats.
+//
+// Hashing the whole prefix every run would take longer than processing
+// it, so the SHA-256 state is saved and extended with only the new bytes.
+// It's saved as of the start of the prefix's last incrementalTail bytes,
+// which are re-read to check Checksum, and the bytes before them are
+// checked by Sample (see sampleChecksum).
+type incrementalState struct {
+	Path     string `json:"path"`
+	Offset   int64  `json:"offset"`
+	Digest   []byte `json:"digest"`   // marshaled SHA-256 state up to tailStart(Offset)
+	Checksum []byte `json:"checksum"` // SHA-256 of the first Offset bytes
+	Sample   []byte `json:"sample"`   // sampleChecksum up to tailStart(Offset)
+	Options  string `json:"options"`
+	Snapshot []byte `json:"snapshot"` // station stats in snapshot format
+}
+
+const (
+	incrementalTail = 1024 * 1024 // bytes before Offset re-read to verify the state
+	sampleBlocks    = 16
+	sampleBlockSize = 4096
+)
+
+// tailStart returns the start of the incrementalTail bytes before offset.
+func tailStart(offset int64) int64 {
+	return max(offset-incrementalTail, 0)
+}
+
+// sampleChecksum returns a checksum of sampleBlocks evenly-spaced blocks
+// from the first size bytes of f, to catch the file being rewritten
+// without reading all of it.
+func sampleChecksum(f io.ReaderAt, size int64) ([]byte, error) {
+	h := sha256.New()
+	buf := make([]byte, sampleBlockSize)
+	for i := int64(0); i < sampleBlocks; i++ {
+		offset := size * i / sampleBlocks
+		n := min(sampleBlockSize, size-offset)
+		_, err := f.ReadAt(buf[:n], offset)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(buf[:n])
+	}
+	return h.Sum(nil), nil
+}
+
+// restoreDigest returns a SHA-256 hash restored from a saved state.
+func restoreDigest(state []byte) (hash.Hash, error) {
+	h := sha256.New()
+	err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// hashRange adds bytes start to end of f to h.
+func hashRange(h hash.Hash, f io.ReaderAt, start, end int64) error {
+	_, err := io.Copy(h, io.NewSectionReader(f, start, end-start))
+	return err
+}
+
+// verifyIncrementalState reports whether the first state.Offset bytes of
+// f are (very likely) the ones state was saved for.
+func verifyIncrementalState(f io.ReaderAt, state *incrementalState) (bool, error) {
+	h, err := restoreDigest(state.Digest)
+	if err != nil {
+		return false, nil // saved by an older version: start again
+	}
+	mark := tailStart(state.Offset)
+	sample, err := sampleChecksum(f, mark)
+	if err != nil {
+		return false, err
+	}
+	err = hashRange(h, f, mark, state.Offset)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sample, state.Sample) && bytes.Equal(h.Sum(nil), state.Checksum), nil
+}
+
+// runIncremental aggregates inputPath, starting from the state saved in
+// statePath by a previous run if there is one, writes the results to
+// output, and saves the new state. If the file has been truncated or
+// rewritten, or options is different, since the state was saved, it
+// starts again from scratch.
+func runIncremental(ctx context.Context, inputPath, statePath, options string, output io.Writer) error {
+	absPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	enc, err := detectEncoding(f, st.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %w", inputPath, err)
+	}
+	if enc.order != nil {
+		return fmt.Errorf("%s: -incremental doesn't support UTF-16 input", inputPath)
+	}
+
+	totals := make(map[string]*r10Stats)
+	var offset int64
+	var digest []byte // saved hash state to extend, if resuming
+	state, err := readIncrementalState(statePath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case state.Path != absPath:
+		return fmt.Errorf("%s is the state for %s, not %s", statePath, state.Path, absPath)
+	case state.Options != options:
+		fmt.Fprintf(os.Stderr, "warning: options have changed since %s was saved, starting again\n", statePath)
+	case state.Offset > st.Size():
+		fmt.Fprintf(os.Stderr, "warning: %s was truncated, starting again\n", inputPath)
+	default:
+		ok, err := verifyIncrementalState(f, state)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "warning: %s was rewritten, starting again\n", inputPath)
+			break
+		}
+		results, _, err := decodeSnapshot(state.Snapshot)
+		if err != nil {
+			return fmt.Errorf("%s: %w", statePath, err)
+		}
+		for _, r := range results {
+			totals[r.station] = &r10Stats{
+				min:   r.min,
+				max:   r.max,
+				sum:   r.sum,
+				count: r.count,
+				hist:  histSlice(r.hist),
+				cols:  r.cols,
+			}
+		}
+		offset = state.Offset
+		digest = state.Digest
+	}
+
+	offset = max(offset, enc.bom)
+
+	// Only process up to the end of the last complete line, as the rest
+	// of the last line may still be being written.
+	end, err := lastLineEnd(f, offset, st.Size())
+	if err != nil {
+		return err
+	}
+	covered := []byteRange{{inputPath, 0, offset}}
+	stopped := false
+	if end > offset {
+		res, err := r10AggregateRange(ctx, f, offset, end)
+		if err != nil {
+			return err
+		}
+		r10Merge(totals, res.totals)
+		covered = append(covered, res.covered...)
+		stopped = res.stopped
+	}
+
+	results := r10Results(totals)
+	err = outputResults(output, results)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), covered} // don't save partial state
+	}
+
+	// Extend the saved hash state (from the start of the old tail) to the
+	// start of the new tail, save it, then hash the tail for the checksum.
+	h := sha256.New()
+	var hashed int64
+	if digest != nil {
+		h, err = restoreDigest(digest)
+		if err != nil {
+			return err
+		}
+		hashed = tailStart(offset)
+	}
+	mark := tailStart(end)
+	err = hashRange(h, f, hashed, mark)
+	if err != nil {
+		return err
+	}
+	digest, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	err = hashRange(h, f, mark, end)
+	if err != nil {
+		return err
+	}
+	sample, err := sampleChecksum(f, mark)
+	if err != nil {
+		return err
+	}
+
+	var snapshot bytes.Buffer
+	err = encodeSnapshot(&snapshot, results)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(incrementalState{absPath, end, digest, h.Sum(nil), sample, options, snapshot.Bytes()})
+	})
+}
+
+func readIncrementalState(path string) (*incrementalState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state incrementalState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// lastLineEnd returns the offset just after the last newline in f between
+// start and end, or start if there isn't one.
+func lastLineEnd(f io.ReaderAt, start, end int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for end > start {
+		n := min(int64(len(buf)), end-start)
+		_, err := f.ReadAt(buf[:n], end-n)
+		if err != nil {
+			return 0, err
+		}
+		newline := bytes.LastIndexByte(buf[:n], '\n')
+		if newline >= 0 {
+			return end - n + int64(newline) + 1, nil
+		}
+		end -= n
+	}
+	return start, nil
+}
+
+// r10AggregateRange processes bytes start to end of f, which must be on
+// line boundaries, in parallel like r10Aggregate does for whole files.
+func r10AggregateRange(ctx context.Context, f *os.File, start, end int64) (*r10Result, error) {
+	mark := time.Now()
+	// Split at the first newline after each evenly-spaced offset.
+	var parts []part
+	buf := make([]byte, 128)
+	offset := start
+	splitSize := (end - start) / int64(maxGoroutines)
+	for i := 1; i < maxGoroutines; i++ {
+		splitAt := max(start+int64(i)*splitSize, offset)
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), end-splitAt)], splitAt)
+		if err != nil {
+			return nil, err
+		}
+		newline := bytes.IndexByte(buf[:n], '\n')
+		if newline < 0 || splitAt+int64(newline)+1 >= end {
+			break
+		}
+		next := splitAt + int64(newline) + 1
+		parts = append(parts, part{f.Name(), offset, next - offset})
+		offset = next
+	}
+	parts = append(parts, part{f.Name(), offset, end - offset})
+	timings.record(phaseSplit, mark)
+
+	resultsCh := make(chan partResult[*r10Stats])
+	runParts(parts, func(p part) {
+		r10ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+	})
+
+	res := &r10Result{totals: make(map[string]*r10Stats)}
+	for range parts {
+		result := <-resultsCh
+		mergeStart := time.Now()
+		res.covered = append(res.covered, result.covered)
+		res.stopped = res.stopped || result.stopped
+		r10Merge(res.totals, result.stats)
+		timings.record(phaseMerge, mergeStart)
+	}
+	return res, nil
+}
@@ -0,0 +1,214 @@
+// Handling of multiple input files, globs and directories
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// perFile is set by -perfile to output results for each input file as
+// well as the combined result.
+var perFile bool
+
+// expandInputs turns command line arguments into a list of input files.
+// Globs are expanded, and directories are replaced by the regular files
+// they contain (not recursively, and skipping hidden files), in sorted
+// order. A file named more than once is only included once.
+func expandInputs(args []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob %q: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+		}
+
+		for _, match := range matches {
+			st, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !st.IsDir() {
+				add(match)
+				continue
+			}
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries { // ReadDir sorts by name
+				if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+				add(filepath.Join(match, entry.Name()))
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("no input files")
+	}
+	return paths, nil
+}
+
+// inputsSize returns the total size in bytes of the given files.
+func inputsSize(paths []string) (int64, error) {
+	var total int64
+	for _, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		total += st.Size()
+	}
+	return total, nil
+}
+
+// multiFile reads a sequence of input files as one stream, for the
+// single-threaded revisions. A newline is added after any file that
+// doesn't end with one so that lines from adjacent files are never joined.
+// Each file's text is read as UTF-8 (see inputEncoding).
+type multiFile struct {
+	r     io.Reader
+	files []*os.File
+	paths []string
+	sizes []int64 // real size of each file
+	encs  []inputEncoding
+	added []int64 // 1 if a newline was added after the file's text
+}
+
+func openInputs(paths []string) (*multiFile, error) {
+	m := &multiFile{}
+	var readers []io.Reader
+	for _, path := range paths {
+		f, size, enc, err := openEncoding(path)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.files = append(m.files, f)
+		readers = append(readers, enc.reader(progressReader{io.NewSectionReader(f, enc.bom, size-enc.bom)}))
+
+		var added int64
+		nl := enc.newline()
+		if size > enc.bom {
+			last := make([]byte, len(nl))
+			_, err := f.ReadAt(last, max(size-int64(len(nl)), enc.bom))
+			if err != nil && err != io.EOF {
+				m.Close()
+				return nil, err
+			}
+			if !bytes.Equal(last, nl) {
+				readers = append(readers, strings.NewReader("\n"))
+				added = 1
+			}
+		}
+
+		m.paths = append(m.paths, path)
+		m.sizes = append(m.sizes, size)
+		m.encs = append(m.encs, enc)
+		m.added = append(m.added, added)
+	}
+	m.r = io.MultiReader(readers...)
+	return m, nil
+}
+
+// Read fills as much of buf as possible, so that (as with a single file)
+// a short read only happens at the end of the stream. Otherwise a read
+// could stop at a file boundary in the middle of a line.
+func (m *multiFile) Read(buf []byte) (int, error) {
+	n, err := io.ReadFull(m.r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (m *multiFile) Close() error {
+	var firstErr error
+	for _, f := range m.files {
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ranges converts the first n bytes of the stream to per-file ranges.
+func (m *multiFile) ranges(n int64) []byteRange {
+	var ranges []byteRange
+	for i, path := range m.paths {
+		if n <= 0 {
+			break
+		}
+		enc := m.encs[i]
+		raw, text := enc.span(m.files[i], enc.bom, m.sizes[i]-enc.bom, n)
+		ranges = append(ranges, byteRange{path, 0, enc.bom + raw})
+		n -= text + m.added[i]
+	}
+	return ranges
+}
+
+// splitFiles splits the input files into parts for the parallel
+// revisions, sharing numParts between the files in proportion to their
+// size (but with at least one part for each non-empty file).
+func splitFiles(paths []string, numParts int) ([]part, error) {
+	sizes := make([]int64, len(paths))
+	var total int64
+	for i, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = st.Size()
+		total += sizes[i]
+	}
+
+	var parts []part
+	for i, path := range paths {
+		if sizes[i] == 0 {
+			continue
+		}
+		n := max(int(int64(numParts)*sizes[i]/total), 1)
+		fileParts, err := splitFile(path, n)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, fileParts...)
+	}
+	return parts, nil
+}
+
+// runParts calls process for each part in its own goroutine, with at most
+// maxGoroutines running at once.
+func runParts(parts []part, process func(part)) {
+	sem := make(chan struct{}, maxGoroutines)
+	for _, p := range parts {
+		go func(p part) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			process(p)
+		}(p)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenInputsJoinsLines(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	err := os.WriteFile(a, []byte("Foo;1.0\nBar;2.0"), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", a, err)
+	}
+	err = os.WriteFile(b, []byte("Baz;3.0\n"), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", b, err)
+	}
+
+	paths, err := expandInputs([]string{dir})
+	if err != nil {
+		t.Fatalf("Failed to expand %s: %v", dir, err)
+	}
+	if len(paths) != 2 || paths[0] != a || paths[1] != b {
+		t.Fatalf("Want paths [%s %s], got %v", a, b, paths)
+	}
+
+	f, err := openInputs(paths)
+	if err != nil {
+		t.Fatalf("Failed to open inputs: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Failed to read inputs: %v", err)
+	}
+	want := "Foo;1.0\nBar;2.0\nBaz;3.0\n"
+	if string(data) != want {
+		t.Errorf("Want %q, got %q", want, data)
+	}
+
+	ranges := f.ranges(int64(len("Foo;1.0\nBar;2.0\nBaz")))
+	if len(ranges) != 2 || ranges[0].end != 15 || ranges[1].end != 3 {
+		t.Errorf("Want ranges ending at 15 and 3, got %v", ranges)
+	}
+}
@@ -0,0 +1,182 @@
+// Streaming ingestion: "go-1brc serve -tcp=ADDR" accepts station;temp
+// lines over raw TCP connections and keeps live aggregates that can be
+// queried over HTTP
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+const liveShards = 64 // number of shards in a liveTable (power of 2)
+
+// liveTable is a concurrent station table that's updated as readings
+// arrive. It's sharded by a hash of the station name so that connections
+// updating different stations rarely contend for the same lock.
+type liveTable struct {
+	shards [liveShards]liveShard
+}
+
+type liveShard struct {
+	mu    sync.Mutex
+	stats map[string]*r10Stats
+}
+
+func newLiveTable() *liveTable {
+	t := &liveTable{}
+	for i := range t.shards {
+		t.shards[i].stats = make(map[string]*r10Stats)
+	}
+	return t
+}
+
+// add records a single reading (in tenths of a degree) for station.
+func (t *liveTable) add(station []byte, temp int32) {
+	const (
+		// FNV-1 64-bit constants from hash/fnv.
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	hash := uint64(offset64)
+	for _, c := range station {
+		hash ^= uint64(c) // FNV-1a is XOR then *
+		hash *= prime64
+	}
+	shard := &t.shards[hash&(liveShards-1)]
+
+	shard.mu.Lock()
+	s := shard.stats[string(station)]
+	if s == nil {
+		shard.stats[string(station)] = &r10Stats{
+			min:   temp,
+			max:   temp,
+			sum:   int64(temp),
+			count: 1,
+		}
+	} else {
+		s.min = min(s.min, temp)
+		s.max = max(s.max, temp)
+		s.sum += int64(temp)
+		s.count++
+	}
+	shard.mu.Unlock()
+}
+
+// snapshot returns a copy of the current stats for every station.
+func (t *liveTable) snapshot() map[string]*r10Stats {
+	totals := make(map[string]*r10Stats)
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for station, s := range shard.stats {
+			c := *s
+			totals[station] = &c
+		}
+		shard.mu.Unlock()
+	}
+	return totals
+}
+
+// serveTCP accepts connections on ln and adds the readings sent on each
+// to table, until ctx is cancelled.
+func serveTCP(ctx context.Context, ln net.Listener, table *liveTable) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleIngestConn(ctx, conn, table)
+		}()
+	}
+}
+
+// handleIngestConn reads newline-delimited station;temp readings from
+// conn until it's closed. Unlike the batch revisions, input comes from
+// the network so malformed lines are skipped (and counted) rather than
+// trusted.
+func handleIngestConn(ctx context.Context, conn net.Conn, table *liveTable) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var rows, bad int64
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		station, tempBytes, hasSemi := bytes.Cut(line, []byte(";"))
+		if !hasSemi || len(station) == 0 {
+			bad++
+			continue
+		}
+		temp, ok := parseTemp(tempBytes)
+		if !ok {
+			bad++
+			continue
+		}
+		table.add(station, temp)
+		rows++
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("%s: %v", conn.RemoteAddr(), err)
+	}
+	if bad > 0 {
+		log.Printf("%s: added %d rows, skipped %d malformed lines", conn.RemoteAddr(), rows, bad)
+	}
+}
+
+// parseTemp parses a temperature like "-12.3" into fixed point tenths,
+// as in r4, but checks the format instead of assuming it's valid.
+func parseTemp(b []byte) (int32, bool) {
+	negative := false
+	if len(b) > 0 && b[0] == '-' {
+		negative = true
+		b = b[1:]
+	}
+	if len(b) < 3 || len(b) > 4 || b[len(b)-2] != '.' {
+		return 0, false
+	}
+	var temp int32
+	for i, c := range b {
+		if i == len(b)-2 {
+			continue // skip '.'
+		}
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		temp = temp*10 + int32(c-'0')
+	}
+	if negative {
+		temp = -temp
+	}
+	return temp, true
+}
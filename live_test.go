@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseTemp(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int32
+		ok    bool
+	}{
+		{"0.0", 0, true},
+		{"1.5", 15, true},
+		{"-1.5", -15, true},
+		{"99.9", 999, true},
+		{"-99.9", -999, true},
+		{"", 0, false},
+		{"-", 0, false},
+		{"1", 0, false},
+		{"1.", 0, false},
+		{"1.23", 0, false},
+		{"100.0", 0, false},
+		{"1x5", 0, false},
+		{"a.5", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseTemp([]byte(test.input))
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseTemp(%q): want %d, %v, got %d, %v", test.input, test.want, test.ok, got, ok)
+		}
+	}
+}
@@ -3,38 +3,100 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"math"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"slices"
+	"strings"
 	"time"
 )
 
-type revisionFunc func(string, io.Writer) error
-
-var revisionFuncs = []revisionFunc{r1, r2, r3, r4, r5, r6, r7, r8, r9, r10}
-
 var maxGoroutines int
 
+// subcommands are run as "go-1brc NAME [options] ...".
+var subcommands = map[string]func(args []string) error{
+	"serve":       runServe,
+	"merge":       runMerge,
+	"coordinator": runCoordinator,
+	"worker":      runWorker,
+}
+
 func main() {
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		err := subcommands[os.Args[1]](os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var (
 		cpuProfile = flag.String("cpuprofile", "", "write CPU profile to file")
-		revision   = flag.Int("revision", len(revisionFuncs), "revision of solution to run")
+		revName    = flag.String("revision", defaultRevision, "revision of solution to run, by name or alias like r10 or swar, or number (see -list)")
+		list       = flag.Bool("list", false, "list the revisions and exit")
 		goroutines = flag.Int("goroutines", 0, "num goroutines for parallel solutions (default NumCPU)")
 		benchAll   = flag.Bool("benchall", false, "benchmark all solutions")
+		showTimes  = flag.Bool("timings", false, "print per-phase timing breakdown to stderr")
+		progress   = flag.Bool("progress", false, "print progress, throughput and ETA to stderr")
+		perFileArg = flag.Bool("perfile", false, "also output results for each input file (parallel revisions only)")
+		follow     = flag.Bool("follow", false, "keep processing lines appended to INPUT (see -list)")
+		interval   = flag.Duration("interval", time.Second, "how often to check for new lines with -follow")
+		outPath    = flag.String("out", "", "with -follow, write results to this file instead of stdout")
+		format     = flag.String("format", "text", "output format: "+strings.Join(outputFormats, ", "))
+		station    = flag.String("station", "", "only include these stations (comma-separated, or @FILE with one per line)")
+		prefix     = flag.String("prefix", "", "only include stations whose names start with this")
+		match      = flag.String("match", "", "only include stations whose names match this regex")
+		normalize  = flag.String("normalize", "", "merge stations whose names are the same in this Unicode normalization form: nfc, nfd, nfkc or nfkd")
+		fold       = flag.Bool("fold", false, "merge stations whose names differ only in case")
+		invalid    = flag.String("invalidutf8", "", "what to do with station names that aren't valid UTF-8: "+strings.Join(invalidUTF8Policies, ", ")+" (default leave as is)")
+		minVal     = flag.Float64("minval", math.Inf(-1), "discard readings below this temperature in Celsius (see -list)")
+		maxVal     = flag.Float64("maxval", math.Inf(1), "discard readings above this temperature in Celsius (see -list)")
+		outliers   = flag.Float64("outliers", 0, "discard readings more than this many MADs from each station's median (see -list)")
+		unit       = flag.String("unit", "C", "output temperatures in this unit: "+strings.Join(outputUnits, ", "))
+		columns    = flag.String("columns", "", "names of the value columns if there's more than one, like temp,humidity (see -list)")
+		window     = flag.String("window", "", "input has a timestamp;station;temp format: aggregate per station per window, like 1h or 1d")
+		groupBy    = flag.String("groupby", "", "roll stations up by prefix:N (first N characters) or split:SEP:N (first N fields)")
+		leaves     = flag.Bool("leaves", false, "with -groupby, also output the stations in each group")
+		top        = flag.Int("top", 0, "only output the N stations with the highest -by value")
+		bottom     = flag.Int("bottom", 0, "only output the N stations with the lowest -by value")
+		by         = flag.String("by", "mean", "value to rank -top or -bottom by: "+strings.Join(rankFields, ", "))
+		sortField  = flag.String("sort", "name", "order results by: "+strings.Join(sortFields, ", "))
+		desc       = flag.Bool("desc", false, "with -sort, order results in descending order")
+		collation  = flag.String("collate", "", "compare station names using this locale's collation, like de or sv (default byte order)")
+		snapshot   = flag.String("snapshot", "", "also write the final results to this snapshot file (see merge)")
+		stateFile  = flag.String("incremental", "", "keep state in this file and only process lines appended to INPUT since the last run (see -list)")
+		checkpoint = flag.String("checkpoint", "", "save completed parts to this directory and resume from them (parallel revisions only)")
+		cache      = flag.String("cache", os.Getenv("GO1BRC_CACHE"), "cache results in this directory (default $GO1BRC_CACHE)")
+		noCache    = flag.Bool("nocache", false, "don't read or write the result cache")
+		verify     = flag.Bool("verifycache", false, "recompute results and check them against the cache entry")
+		timeout    = flag.Duration("timeout", 0, "stop after this long and print partial result (default no timeout)")
 	)
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(),
-			"Usage: go-r1bc [-cpuprofile=PROFILE] [-revision=N] INPUTFILE\n")
+			"Usage: go-1brc [options] INPUT...\n"+
+				"       go-1brc serve [options]\n"+
+				"       go-1brc merge [options] SNAPSHOT...\n"+
+				"       go-1brc coordinator -workers=ADDR,... [options] INPUT...\n"+
+				"       go-1brc worker [options]\n\n"+
+				"Each INPUT may be a file, a glob, or a directory of files.\n\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	if *revision < 1 || *revision > len(revisionFuncs) {
-		fmt.Fprintf(os.Stderr, "invalid revision %d\n", *revision)
+	if *list {
+		writeRevisions(os.Stdout)
+		return
+	}
+	revision, err := findRevision(*revName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 	maxGoroutines = *goroutines
@@ -42,19 +104,180 @@ func main() {
 		maxGoroutines = runtime.NumCPU()
 	}
 
+	if !slices.Contains(outputFormats, *format) {
+		fmt.Fprintf(os.Stderr, "invalid format %q\n", *format)
+		os.Exit(1)
+	}
+	outputFormat = *format
+	if !slices.Contains(outputUnits, *unit) {
+		fmt.Fprintf(os.Stderr, "invalid unit %q\n", *unit)
+		os.Exit(1)
+	}
+	outputUnit = *unit
+	snapshotPath = *snapshot
+	perFile = *perFileArg
+	checkpointDir = *checkpoint
+
+	filter, err := newStationFilter(*station, *prefix, *match)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	stationFilter = filter
+
+	if *invalid != "" && !slices.Contains(invalidUTF8Policies, *invalid) {
+		fmt.Fprintf(os.Stderr, "invalid -invalidutf8 policy %q\n", *invalid)
+		os.Exit(1)
+	}
+	invalidUTF8 = *invalid
+	normalizeName, err = newNormalizer(*normalize, *fold)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *window != "" {
+		windowSize, err = parseWindow(*window)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		if outputFormat == "prometheus" {
+			fmt.Fprintf(os.Stderr, "-window isn't supported with -format=prometheus\n")
+			os.Exit(1)
+		}
+	}
+
+	if *groupBy != "" {
+		groupKey, err = parseGroupBy(*groupBy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	groupLeaves = *leaves
+	if groupLeaves && (groupKey == nil || outputFormat != "text" || perFile) {
+		fmt.Fprintf(os.Stderr, "-leaves requires -groupby and -format=text, without -perfile\n")
+		os.Exit(1)
+	}
+
+	minValue, maxValue, outlierK = *minVal, *maxVal, *outliers
+	if outlierK < 0 || minValue > maxValue {
+		fmt.Fprintf(os.Stderr, "invalid -minval, -maxval or -outliers\n")
+		os.Exit(1)
+	}
+	if rejectingReadings() {
+		if perFile || *follow {
+			fmt.Fprintf(os.Stderr, "-minval, -maxval and -outliers aren't supported with -perfile or -follow\n")
+			os.Exit(1)
+		}
+		collectHist = true
+	}
+
+	if *columns != "" {
+		valueColumns = strings.Split(*columns, ",")
+	}
+	if len(valueColumns) > 1 {
+		if outputFormat == "prometheus" || rejectingReadings() {
+			fmt.Fprintf(os.Stderr, "-columns isn't supported with -format=prometheus, -minval, -maxval or -outliers\n")
+			os.Exit(1)
+		}
+	}
+
+	if !slices.Contains(rankFields, *by) {
+		fmt.Fprintf(os.Stderr, "invalid -by value %q\n", *by)
+		os.Exit(1)
+	}
+	if *top < 0 || *bottom < 0 || (*top > 0 && *bottom > 0) {
+		fmt.Fprintf(os.Stderr, "specify a positive -top or -bottom, not both\n")
+		os.Exit(1)
+	}
+	rankN = max(*top, *bottom)
+	rankBottom = *bottom > 0
+	rankBy = *by
+
+	if !slices.Contains(sortFields, *sortField) {
+		fmt.Fprintf(os.Stderr, "invalid -sort value %q\n", *sortField)
+		os.Exit(1)
+	}
+	if rankN > 0 && (*sortField != "name" || *desc) {
+		fmt.Fprintf(os.Stderr, "-sort and -desc can't be used with -top or -bottom\n")
+		os.Exit(1)
+	}
+	sortBy = *sortField
+	sortDesc = *desc
+	if *collation != "" {
+		sortCollator, err = newCollator(*collation)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if perFile && outputFormat != "text" {
+		fmt.Fprintf(os.Stderr, "-perfile is only supported with -format=text\n")
+		os.Exit(1)
+	}
+	if checkpointDir != "" && (*follow || *benchAll) {
+		fmt.Fprintf(os.Stderr, "-checkpoint isn't supported with -follow or -benchall\n")
+		os.Exit(1)
+	}
+
+	// An option the selected revision doesn't support is an error, rather
+	// than quietly running another one. The exception is -window, which
+	// uses the window revision unless one is given with -revision.
+	var needs capability
+	if perFile {
+		needs |= capPerFile
+	}
+	if checkpointDir != "" {
+		needs |= capCheckpoint
+	}
+	if collectHist {
+		needs |= capHistograms
+	}
+	if len(valueColumns) > 1 {
+		needs |= capColumns
+	}
+	if *follow {
+		needs |= capFollow
+	}
+	if *stateFile != "" {
+		needs |= capIncremental
+	}
+	if windowSize != 0 {
+		revisionSet := false
+		flag.Visit(func(f *flag.Flag) {
+			revisionSet = revisionSet || f.Name == "revision"
+		})
+		if !revisionSet {
+			revision, _ = findRevision("window")
+		}
+		needs |= capWindow
+	} else if revision.has(capWindow) {
+		fmt.Fprintf(os.Stderr, "revision %s requires -window\n", revision.name)
+		os.Exit(1)
+	}
+	if missing := revision.missing(needs); missing != "" {
+		fmt.Fprintf(os.Stderr, "revision %s doesn't support %s (see -list)\n", revision.name, missing)
+		os.Exit(1)
+	}
+
 	args := flag.Args()
 	if len(args) < 1 {
 		flag.Usage()
 		os.Exit(2)
 	}
-	inputPath := args[0]
-
-	st, err := os.Stat(inputPath)
+	inputPaths, err := expandInputs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	size, err := inputsSize(inputPaths)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
-	size := st.Size()
 
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
@@ -66,8 +289,38 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	// On Ctrl-C, stop workers and print the partial result. Restore the
+	// default handler after the first one so a second Ctrl-C still kills.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-sigCtx.Done()
+		stop()
+	}()
+	ctx := sigCtx
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
 	if *benchAll {
-		err := benchmarkAll(inputPath)
+		err := benchmarkAll(ctx, inputPaths)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *follow {
+		if len(inputPaths) != 1 {
+			fmt.Fprintf(os.Stderr, "-follow requires a single input file\n")
+			os.Exit(1)
+		}
+		output := bufio.NewWriter(os.Stdout)
+		err := followFile(ctx, inputPaths[0], output, *outPath, *interval)
+		output.Flush()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(1)
@@ -75,27 +328,105 @@ func main() {
 		return
 	}
 
+	timings.reset()
 	start := time.Now()
 	output := bufio.NewWriter(os.Stdout)
 
-	rf := revisionFuncs[*revision-1]
-	err = rf(inputPath, output)
+	// options describes everything besides the input and revision that
+	// affects the results, for the result cache, -incremental state and
+	// -checkpoint manifest.
+	stationsKey, err := stationListKey(*station)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	options := fmt.Sprintf("stations=%s prefix=%q match=%q hist=%v window=%v columns=%q normalize=%q fold=%v invalidutf8=%q",
+		stationsKey, *prefix, *match, collectHist, windowSize, valueColumns, *normalize, *fold, *invalid)
+	checkpointOptions = "revision=" + revision.name + " " + options
+
+	if *stateFile != "" {
+		if len(inputPaths) != 1 {
+			fmt.Fprintf(os.Stderr, "-incremental requires a single input file\n")
+			os.Exit(1)
+		}
+		err := runIncremental(ctx, inputPaths[0], *stateFile, options, output)
+		output.Flush()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Processed %.1fMB in %s\n",
+			float64(size)/(1024*1024), time.Since(start))
+		if *showTimes {
+			timings.print(os.Stderr)
+		}
+		return
+	}
+
+	// The cache isn't used with -perfile as it only stores the totals.
+	cacheDir = *cache
+	useCache := cacheDir != "" && !*noCache && !perFile
+	var cacheKey string
+	if useCache {
+		cacheKey, err = resultCacheKey(inputPaths, "revision="+revision.name+" "+options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		if results, ok := readCache(cacheKey); ok && !*verify {
+			err := outputResults(output, results)
+			output.Flush()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "Processed %.1fMB in %s (cached)\n",
+				float64(size)/(1024*1024), time.Since(start))
+			return
+		}
+		captureResults = true
+	}
+
+	stopProgress := func() {}
+	if *progress {
+		stopProgress = startProgress(os.Stderr, size)
+	}
+
+	err = revision.run(ctx, inputPaths, output)
+	stopProgress()
+	var incomplete *incompleteError
+	if errors.As(err, &incomplete) {
+		output.Flush()
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
 	output.Flush()
+	if useCache {
+		err := writeCache(cacheKey, capturedResults, *verify)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	elapsed := time.Since(start)
 	fmt.Fprintf(os.Stderr, "Processed %.1fMB in %s\n",
 		float64(size)/(1024*1024), elapsed)
+	writeInvalidNames(os.Stderr)
+	if *showTimes {
+		timings.print(os.Stderr)
+	}
 }
 
-func benchmarkAll(inputPath string) error {
+func benchmarkAll(ctx context.Context, inputPaths []string) error {
 	const tries = 5
 
 	var buf bytes.Buffer
-	err := r1(inputPath, &buf)
+	err := r1(ctx, inputPaths, &buf)
 	if err != nil {
 		return err
 	}
@@ -103,13 +434,16 @@ func benchmarkAll(inputPath string) error {
 
 	var r1Best time.Duration
 
-	for i, rf := range revisionFuncs {
-		fmt.Fprintf(os.Stderr, "r%d: ", i+1)
+	for i, rev := range revisions {
+		if rev.has(capWindow) {
+			continue // needs timestamped input
+		}
+		fmt.Fprintf(os.Stderr, "%s: ", rev.name)
 		bestTime := time.Duration(math.MaxInt64)
 		for try := 0; try < tries; try++ {
 			var output bytes.Buffer
 			start := time.Now()
-			err := rf(inputPath, &output)
+			err := rev.run(ctx, inputPaths, &output)
 			if err != nil {
 				return err
 			}
@@ -121,7 +455,7 @@ func benchmarkAll(inputPath string) error {
 			}
 
 			if output.String() != expected {
-				return fmt.Errorf("r%d didn't give correct result", i+1)
+				return fmt.Errorf("%s didn't give correct result", rev.name)
 			}
 		}
 		fmt.Fprintf(os.Stderr, "- best: %v (%.2fx as fast as r1)\n",
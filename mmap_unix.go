@@ -0,0 +1,122 @@
+//go:build linux || darwin || freebsd
+
+// mmap: r10, but each worker parses its part of the file directly from a
+// memory mapping instead of reading it into a buffer. It's only
+// registered on systems that have syscall.Mmap.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"syscall"
+	"time"
+)
+
+func init() {
+	revisions = append(revisions, revision{"mmap", nil,
+		"r10 parsing each part directly from a memory-mapped file instead of reading it", true,
+		capHistograms | capColumns, mmapRun})
+}
+
+func mmapRun(ctx context.Context, inputPaths []string, output io.Writer) error {
+	mark := time.Now()
+	parts, err := splitFiles(inputPaths, maxGoroutines)
+	if err != nil {
+		return err
+	}
+	timings.record(phaseSplit, mark)
+
+	resultsCh := make(chan partResult[*r10Stats])
+	runParts(parts, func(p part) {
+		mmapProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+	})
+
+	var covered []byteRange
+	stopped := false
+	totals := make(map[string]*r10Stats)
+	for i := 0; i < len(parts); i++ {
+		result := <-resultsCh
+		mergeStart := time.Now()
+		covered = append(covered, result.covered)
+		stopped = stopped || result.stopped
+		r10Merge(totals, result.stats)
+		timings.record(phaseMerge, mergeStart)
+	}
+
+	err = outputResults(output, r10Results(totals))
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), covered}
+	}
+	return nil
+}
+
+func mmapProcessPart(ctx context.Context, inputPath string, fileOffset, fileSize int64, resultsCh chan partResult[*r10Stats]) {
+	start := time.Now()
+	f, size, enc, err := openEncoding(inputPath)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	// Map the whole file, as the offset of a mapping has to be a multiple
+	// of the page size (an empty file can't be mapped at all).
+	var data []byte
+	if size > 0 {
+		data, err = syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			panic(err)
+		}
+		defer syscall.Munmap(data)
+	}
+
+	var result map[string]*r10Stats
+	var end int64
+	stopped := false
+	if enc.order != nil {
+		// UTF-16 has to be transcoded, so it's read like r10 does.
+		text := bytes.NewReader(data[fileOffset : fileOffset+fileSize])
+		var processed int64
+		result, processed, err = r10ProcessReader(ctx, enc.reader(progressReader{text}))
+		if err != nil && err != ctx.Err() {
+			panic(err)
+		}
+		raw, _ := enc.span(f, fileOffset, fileSize, processed)
+		end = fileOffset + raw
+		stopped = err != nil
+	} else {
+		table := newR10Table()
+		end = fileOffset
+		for end < fileOffset+fileSize {
+			if ctx.Err() != nil {
+				stopped = true
+				break
+			}
+			// Parse the mapping in chunks of complete lines, to check for
+			// cancellation now and then.
+			chunk := data[end:min(end+1024*1024, fileOffset+fileSize)]
+			newline := bytes.LastIndexByte(chunk, '\n')
+			if newline < 0 {
+				break
+			}
+			chunk = chunk[:newline+1]
+			// The parser reads up to 8 bytes past the chunk, which is only
+			// in the mapping if the chunk isn't at the end of the file.
+			if end+int64(len(chunk))+8 > size {
+				padded := make([]byte, len(chunk)+8)
+				copy(padded, chunk)
+				chunk = padded[:len(chunk)]
+			}
+			table.processChunk(chunk)
+			bytesProcessed.Add(int64(len(chunk)))
+			end += int64(len(chunk))
+		}
+		result = table.stats()
+	}
+	timings.record(phaseParse, start)
+	resultsCh <- partResult[*r10Stats]{result, byteRange{inputPath, fileOffset, end}, stopped}
+}
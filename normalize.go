@@ -0,0 +1,87 @@
+// Name normalization: -normalize and -fold map station names that differ
+// only in Unicode normalization form (or case) to the same station
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeName is set from -normalize and -fold. If it's not nil, r9 and
+// r10 call it once per distinct station name when it's added to their hash
+// table, and aggregate stations by the name it returns, so names that
+// normalize the same are merged. The other revisions normalize in the
+// output stage.
+var normalizeName func(station string) string
+
+var normalForms = map[string]norm.Form{
+	"nfc":  norm.NFC,
+	"nfd":  norm.NFD,
+	"nfkc": norm.NFKC,
+	"nfkd": norm.NFKD,
+}
+
+// newNormalizer returns a function that case folds a name if fold is true
+// and then converts it to the given normalization form (if form isn't ""),
+// or nil if neither is given.
+func newNormalizer(form string, fold bool) (func(string) string, error) {
+	var f norm.Form
+	if form != "" {
+		var ok bool
+		f, ok = normalForms[strings.ToLower(form)]
+		if !ok {
+			return nil, fmt.Errorf("invalid -normalize %q: must be nfc, nfd, nfkc or nfkd", form)
+		}
+	}
+	switch {
+	case form != "" && fold:
+		return func(station string) string {
+			// A Caser isn't safe for concurrent use, and this is called
+			// from every worker, so create one each time.
+			return f.String(cases.Fold().String(station))
+		}, nil
+	case form != "":
+		return f.String, nil
+	case fold:
+		return func(station string) string {
+			return cases.Fold().String(station)
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// stationName returns the name a station with the given key is aggregated
+// under: with the -invalidutf8 policy applied, and normalized if
+// normalizeName is set. It returns ok false if the policy drops the
+// station.
+func stationName(key []byte) (name string, ok bool) {
+	name, ok = fixUTF8(string(key))
+	if ok && normalizeName != nil {
+		name = normalizeName(name)
+	}
+	return name, ok
+}
+
+// normalizeResults applies stationName to the names of results, merging
+// those that end up the same and dropping those it rejects. It's used in
+// the output stage for revisions that don't do this as they aggregate.
+func normalizeResults(results []stationResult) []stationResult {
+	if normalizeName == nil && invalidUTF8 == "" {
+		return results
+	}
+	totals := make(map[string]*stationResult, len(results))
+	for _, r := range results {
+		var ok bool
+		r.station, ok = stationName([]byte(r.station))
+		if !ok {
+			continue
+		}
+		mergeResults(totals, []stationResult{r})
+	}
+	return resultsSlice(totals)
+}
@@ -0,0 +1,162 @@
+// Value filtering and outlier rejection: -minval, -maxval and -outliers
+// drop readings after aggregation, using the per-station histograms that
+// r10 collects when they're set
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+)
+
+// minValue, maxValue and outlierK are set by -minval, -maxval and
+// -outliers. Readings outside [minValue, maxValue] are discarded, and if
+// outlierK is non-zero, so are readings more than outlierK times the
+// median absolute deviation (MAD) from a station's median.
+var (
+	minValue = math.Inf(-1)
+	maxValue = math.Inf(1)
+	outlierK float64
+)
+
+// rejectingReadings reports whether any of the options to discard
+// readings are set.
+func rejectingReadings() bool {
+	return !math.IsInf(minValue, -1) || !math.IsInf(maxValue, 1) || outlierK != 0
+}
+
+// rejectReadings returns results with the readings excluded by -minval,
+// -maxval and -outliers removed, and the number of readings discarded from
+// each station. Each station's stats are recomputed from its histogram,
+// which is a second pass over the distinct temperatures rather than over
+// the input. Stations with no readings left are dropped.
+func rejectReadings(results []stationResult) ([]stationResult, map[string]int64) {
+	if !rejectingReadings() {
+		return results, nil
+	}
+	// Convert the bounds to tenths, keeping readings that are exactly on
+	// them.
+	lo := int32(max(math.Ceil(math.Round(minValue*1000)/100), math.MinInt32))
+	hi := int32(min(math.Floor(math.Round(maxValue*1000)/100), math.MaxInt32))
+
+	var kept []stationResult
+	discarded := make(map[string]int64)
+	for _, r := range results {
+		temps := make([]int32, 0, len(r.hist))
+		for temp := range r.hist {
+			if temp >= lo && temp <= hi {
+				temps = append(temps, temp)
+			}
+		}
+		slices.Sort(temps)
+
+		if outlierK != 0 {
+			temps = rejectOutliers(temps, r.hist, outlierK)
+		}
+
+		s := stationResult{station: r.station, window: r.window, hist: make(map[int32]int64, len(temps))}
+		for i, temp := range temps {
+			n := r.hist[temp]
+			if i == 0 {
+				s.min = temp
+			}
+			s.max = temp
+			s.sum += int64(temp) * n
+			s.count += n
+			s.hist[temp] = n
+		}
+		if s.count < r.count {
+			discarded[r.name()] = r.count - s.count
+		}
+		if s.count > 0 {
+			kept = append(kept, s)
+		}
+	}
+	return kept, discarded
+}
+
+// rejectOutliers returns the temperatures in temps (which is sorted) that
+// are within k MADs of the median, weighting each by its count in hist.
+// Temperatures are in tenths, as are the median and MAD.
+func rejectOutliers(temps []int32, hist map[int32]int64, k float64) []int32 {
+	var n int64
+	for _, temp := range temps {
+		n += hist[temp]
+	}
+	values := make([]float64, len(temps))
+	counts := make([]int64, len(temps))
+	for i, temp := range temps {
+		values[i] = float64(temp)
+		counts[i] = hist[temp]
+	}
+	median := weightedMedian(values, counts, n)
+
+	deviations := make([]float64, len(temps))
+	order := make([]int, len(temps))
+	for i := range temps {
+		deviations[i] = math.Abs(values[i] - median)
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return deviations[order[a]] < deviations[order[b]]
+	})
+	sortedDevs := make([]float64, len(order))
+	sortedCounts := make([]int64, len(order))
+	for i, j := range order {
+		sortedDevs[i] = deviations[j]
+		sortedCounts[i] = counts[j]
+	}
+	// If more than half the readings are the same, the MAD is 0 and every
+	// other reading would be discarded, so it's at least one histogram
+	// bucket (0.1 degrees).
+	mad := max(weightedMedian(sortedDevs, sortedCounts, n), 1)
+
+	var kept []int32
+	for i, temp := range temps {
+		if deviations[i] <= k*mad {
+			kept = append(kept, temp)
+		}
+	}
+	return kept
+}
+
+// weightedMedian returns the median of n values, where values is sorted
+// and values[i] occurs counts[i] times. For an even n, it's the mean of
+// the two middle values.
+func weightedMedian(values []float64, counts []int64, n int64) float64 {
+	if n == 0 {
+		return 0
+	}
+	nth := func(pos int64) float64 {
+		for i, c := range counts {
+			if pos < c {
+				return values[i]
+			}
+			pos -= c
+		}
+		return values[len(values)-1]
+	}
+	return (nth((n-1)/2) + nth(n/2)) / 2
+}
+
+// writeDiscarded reports the number of readings discarded from each
+// station, as returned by rejectReadings.
+func writeDiscarded(w io.Writer, discarded map[string]int64) {
+	if len(discarded) == 0 {
+		return
+	}
+	stations := make([]string, 0, len(discarded))
+	var total int64
+	for station, n := range discarded {
+		stations = append(stations, station)
+		total += n
+	}
+	slices.Sort(stations)
+	fmt.Fprintf(w, "Discarded %d readings from %d stations:\n", total, len(stations))
+	for _, station := range stations {
+		fmt.Fprintf(w, "  %s: %d\n", station, discarded[station])
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWeightedMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		counts []int64
+		want   float64
+	}{
+		{nil, nil, 0},
+		{[]float64{5}, []int64{1}, 5},
+		{[]float64{1, 2, 3}, []int64{1, 1, 1}, 2},
+		{[]float64{1, 2, 3, 4}, []int64{1, 1, 1, 1}, 2.5},
+		{[]float64{1, 2, 3}, []int64{1, 1, 5}, 3},
+		{[]float64{1, 2}, []int64{2, 2}, 1.5},
+		{[]float64{1, 2, 10}, []int64{3, 1, 1}, 1},
+	}
+	for _, test := range tests {
+		var n int64
+		for _, c := range test.counts {
+			n += c
+		}
+		got := weightedMedian(test.values, test.counts, n)
+		if got != test.want {
+			t.Errorf("weightedMedian(%v, %v): want %v, got %v", test.values, test.counts, test.want, got)
+		}
+	}
+}
+
+func TestRejectReadings(t *testing.T) {
+	defer func() { minValue, maxValue, outlierK = math.Inf(-1), math.Inf(1), 0 }()
+
+	tests := []struct {
+		name          string
+		min, max, k   float64
+		readings      []int32 // in tenths
+		want          []int32 // readings kept
+		wantDiscarded int64
+	}{
+		{"minval", 0, math.Inf(1), 0, []int32{-10, 0, 10}, []int32{0, 10}, 1},
+		{"maxval", math.Inf(-1), 1, 0, []int32{-10, 0, 10, 11}, []int32{-10, 0, 10}, 1},
+		{"outlier", math.Inf(-1), math.Inf(1), 3, []int32{10, 11, 12, 13, 500}, []int32{10, 11, 12, 13}, 1},
+		{"zero MAD", math.Inf(-1), math.Inf(1), 3, []int32{10, 10, 10, 11, 50}, []int32{10, 10, 10, 11}, 1},
+		{"all discarded", 50, math.Inf(1), 0, []int32{10, 20}, nil, 2},
+	}
+	for _, test := range tests {
+		minValue, maxValue, outlierK = test.min, test.max, test.k
+		in := stationResult{station: "A", hist: make(map[int32]int64)}
+		for _, temp := range test.readings {
+			in.hist[temp]++
+			in.count++
+		}
+		results, discarded := rejectReadings([]stationResult{in})
+
+		if discarded["A"] != test.wantDiscarded {
+			t.Errorf("%s: want %d discarded, got %d", test.name, test.wantDiscarded, discarded["A"])
+		}
+		if test.want == nil {
+			if len(results) != 0 {
+				t.Errorf("%s: want station dropped, got %+v", test.name, results)
+			}
+			continue
+		}
+		want := stationResult{station: "A", hist: make(map[int32]int64)}
+		for i, temp := range test.want {
+			if i == 0 {
+				want.min = temp
+			}
+			want.max = temp
+			want.sum += int64(temp)
+			want.count++
+			want.hist[temp]++
+		}
+		if len(results) != 1 || !reflect.DeepEqual(results[0], want) {
+			t.Errorf("%s: want %+v, got %+v", test.name, want, results)
+		}
+	}
+}
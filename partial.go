@@ -0,0 +1,79 @@
+// Support for cancelling a run and reporting partial results
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// cancelCheckBytes is roughly how often (in input bytes) the line-at-a-time
+// revisions poll their context; ctx.Err() is too slow to call per row.
+const cancelCheckBytes = 1024 * 1024
+
+// byteRange is a half-open range [start, end) of offsets in an input file.
+type byteRange struct {
+	path       string
+	start, end int64
+}
+
+// partResult is what a parallel worker sends back: its station stats plus
+// the range of the file it actually covered, which is less than the whole
+// part if it was cancelled.
+type partResult[S any] struct {
+	stats   map[string]S
+	covered byteRange
+	stopped bool
+}
+
+// incompleteError is returned by a revision that was cancelled before it
+// processed all its input. The partial result has already been written
+// to the output by the time this is returned.
+type incompleteError struct {
+	cause   error
+	covered []byteRange
+}
+
+func (e *incompleteError) Error() string {
+	ranges := mergeRanges(e.covered)
+	strs := make([]string, len(ranges))
+	for i, r := range ranges {
+		strs[i] = fmt.Sprintf("%s:%d-%d", r.path, r.start, r.end)
+	}
+	return fmt.Sprintf("incomplete result (%v), covered bytes %s",
+		e.cause, strings.Join(strs, ", "))
+}
+
+func (e *incompleteError) Unwrap() error {
+	return e.cause
+}
+
+// mergeRanges sorts ranges and joins ones in the same file that touch or
+// overlap.
+func mergeRanges(ranges []byteRange) []byteRange {
+	sorted := make([]byteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.end > r.start {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].path != sorted[j].path {
+			return sorted[i].path < sorted[j].path
+		}
+		return sorted[i].start < sorted[j].start
+	})
+
+	var merged []byteRange
+	for _, r := range sorted {
+		if len(merged) > 0 && r.path == merged[len(merged)-1].path &&
+			r.start <= merged[len(merged)-1].end {
+			last := &merged[len(merged)-1]
+			last.end = max(last.end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
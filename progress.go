@@ -0,0 +1,93 @@
+// Progress reporting for long-running inputs, enabled with -progress
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// bytesProcessed is the number of input bytes read so far by all workers.
+var bytesProcessed atomic.Int64
+
+// progressReader counts bytes read through it in bytesProcessed.
+// openInputs and openPart read the files through one, underneath any
+// UTF-16 transcoding, so that progress is in file bytes like the total.
+type progressReader struct {
+	r io.Reader
+}
+
+func (p progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	bytesProcessed.Add(int64(n))
+	return n, err
+}
+
+// startProgress starts a goroutine that periodically prints percentage,
+// throughput and ETA to w, and returns a function that stops it. If w is
+// a terminal, the status line is redrawn in place; otherwise a new line
+// is printed every few seconds so logs stay readable.
+func startProgress(w *os.File, total int64) (stop func()) {
+	bytesProcessed.Store(0)
+
+	interval := 5 * time.Second
+	isTTY := false
+	if st, err := w.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+		isTTY = true
+		interval = 200 * time.Millisecond
+	}
+
+	start := time.Now()
+	report := func() {
+		done := bytesProcessed.Load()
+		elapsed := time.Since(start)
+		const mb = 1024 * 1024
+		rate := float64(done) / mb / elapsed.Seconds()
+		percent := 100.0
+		if total > 0 {
+			percent = float64(done) * 100 / float64(total)
+		}
+		eta := "?"
+		if done > 0 && done < total {
+			remaining := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+			eta = remaining.Round(time.Second).String()
+		} else if done >= total {
+			eta = "0s"
+		}
+		line := fmt.Sprintf("%5.1f%% %.1f/%.1fMB %.1fMB/s ETA %s",
+			percent, float64(done)/mb, float64(total)/mb, rate, eta)
+		if isTTY {
+			fmt.Fprintf(w, "\r\033[K%s", line)
+		} else {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stopCh:
+				if isTTY {
+					report()
+					fmt.Fprintln(w)
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
@@ -19,12 +19,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/bits"
-	"os"
-	"sort"
+	"time"
 )
 
 const BroadcastSemicolon = 0x3B3B3B3B3B3B3B3B
@@ -32,87 +33,218 @@ const Broadcast0x01 = 0x0101010101010101
 const Broadcast0x80 = 0x8080808080808080
 
 type r10Stats struct {
-	min, max, count int32
-	sum             int64
+	min, max   int32
+	sum, count int64         // count is int64 for long-running ingestion (see live.go)
+	hist       []int64       // readings per temperature if collectHist, see histIndex
+	cols       []columnStats // stats for the extra -columns, if any
 }
 
-func r10(inputPath string, output io.Writer) error {
-	parts, err := splitFile(inputPath, maxGoroutines)
+// errTooManyStations is what r10's parser panics with when its hash table
+// is full, so that callers which recover can tell it from a parse error.
+var errTooManyStations = errors.New("too many items in hash table")
+
+// collectHist is set to make r10 collect a histogram of readings for each
+// station, which is needed for value filtering and outlier rejection.
+var collectHist bool
+
+// histSize is the number of temperatures from -99.9 to 99.9 (in tenths);
+// a reading of temp is counted in hist[temp+histOffset].
+const (
+	histSize   = 1999
+	histOffset = 999
+)
+
+func r10(ctx context.Context, inputPaths []string, output io.Writer) error {
+	if checkpointDir != "" {
+		return runCheckpointed(ctx, inputPaths, output, func(p part, resultsCh chan partResult[*r10Stats]) {
+			r10ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+		}, r10Results)
+	}
+
+	res, err := r10Aggregate(ctx, inputPaths)
+	if err != nil {
+		return err
+	}
+
+	if perFile {
+		for _, path := range inputPaths {
+			fmt.Fprintf(output, "%s: ", path)
+			writeResults(output, r10Results(res.fileTotals[path]), outputFormat)
+		}
+	}
+	err = outputResults(output, r10Results(res.totals))
 	if err != nil {
 		return err
 	}
 
-	resultsCh := make(chan map[string]*r10Stats)
-	for _, part := range parts {
-		go r10ProcessPart(inputPath, part.offset, part.size, resultsCh)
+	if res.stopped {
+		return &incompleteError{ctx.Err(), res.covered}
 	}
+	return nil
+}
 
-	totals := make(map[string]*r10Stats)
+// r10Result is the merged result of processing the input files with r10.
+type r10Result struct {
+	totals     map[string]*r10Stats
+	fileTotals map[string]map[string]*r10Stats // only set with -perfile
+	covered    []byteRange
+	stopped    bool
+}
+
+// r10Aggregate processes all the input files in parallel and merges the
+// results of each part.
+func r10Aggregate(ctx context.Context, inputPaths []string) (*r10Result, error) {
+	mark := time.Now()
+	parts, err := splitFiles(inputPaths, maxGoroutines)
+	if err != nil {
+		return nil, err
+	}
+	timings.record(phaseSplit, mark)
+
+	resultsCh := make(chan partResult[*r10Stats])
+	runParts(parts, func(p part) {
+		r10ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+	})
+
+	res := &r10Result{
+		totals:     make(map[string]*r10Stats),
+		fileTotals: make(map[string]map[string]*r10Stats),
+	}
 	for i := 0; i < len(parts); i++ {
 		result := <-resultsCh
-		for station, s := range result {
-			ts := totals[station]
-			if ts == nil {
-				totals[station] = s
-				continue
+		mergeStart := time.Now()
+		res.covered = append(res.covered, result.covered)
+		res.stopped = res.stopped || result.stopped
+		if perFile {
+			path := result.covered.path
+			if res.fileTotals[path] == nil {
+				res.fileTotals[path] = make(map[string]*r10Stats)
 			}
-			ts.min = min(ts.min, s.min)
-			ts.max = max(ts.max, s.max)
-			ts.sum += s.sum
-			ts.count += s.count
+			r10Merge(res.fileTotals[path], result.stats)
+		}
+		r10Merge(res.totals, result.stats)
+		timings.record(phaseMerge, mergeStart)
+	}
+	return res, nil
+}
+
+// r10Merge adds the per-station stats from result into totals, copying
+// new entries so that totals never shares stats with a part's result.
+func r10Merge(totals, result map[string]*r10Stats) {
+	for station, s := range result {
+		ts := totals[station]
+		if ts == nil {
+			ts = &r10Stats{min: s.min, max: s.max}
+			totals[station] = ts
 		}
+		ts.merge(s)
 	}
+}
 
-	stations := make([]string, 0, len(totals))
-	for station := range totals {
-		stations = append(stations, station)
+// merge adds the stats in s to ts.
+func (ts *r10Stats) merge(s *r10Stats) {
+	ts.min = min(ts.min, s.min)
+	ts.max = max(ts.max, s.max)
+	ts.sum += s.sum
+	ts.count += s.count
+	if s.hist != nil && ts.hist == nil {
+		ts.hist = make([]int64, histSize)
+	}
+	for i, n := range s.hist {
+		ts.hist[i] += n
+	}
+	if s.cols != nil {
+		ts.cols = mergeColumns(ts.cols, s.cols)
 	}
-	sort.Strings(stations)
+}
 
-	fmt.Fprint(output, "{")
-	for i, station := range stations {
-		if i > 0 {
-			fmt.Fprint(output, ", ")
+// r10Results converts totals to results for the output stage.
+func r10Results(totals map[string]*r10Stats) []stationResult {
+	results := make([]stationResult, 0, len(totals))
+	for station, s := range totals {
+		results = append(results, stationResult{
+			station: station,
+			min:     s.min,
+			max:     s.max,
+			sum:     s.sum,
+			count:   s.count,
+			hist:    histMap(s.hist),
+			cols:    s.cols,
+		})
+	}
+	return results
+}
+
+// histMap converts an r10 histogram to the sparse form used by
+// stationResult, or returns nil if hist is nil.
+func histMap(hist []int64) map[int32]int64 {
+	if hist == nil {
+		return nil
+	}
+	m := make(map[int32]int64)
+	for i, n := range hist {
+		if n != 0 {
+			m[int32(i-histOffset)] = n
 		}
-		s := totals[station]
-		mean := float64(s.sum) / float64(s.count) / 10
-		fmt.Fprintf(output, "%s=%.1f/%.1f/%.1f", station, float64(s.min)/10, mean, float64(s.max)/10)
 	}
-	fmt.Fprint(output, "}\n")
+	return m
+}
 
-	return nil
+// histSlice converts a stationResult histogram back to r10's form.
+func histSlice(m map[int32]int64) []int64 {
+	if m == nil {
+		return nil
+	}
+	hist := make([]int64, histSize)
+	for temp, n := range m {
+		hist[temp+histOffset] += n
+	}
+	return hist
 }
 
-func r10ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan map[string]*r10Stats) {
-	file, err := os.Open(inputPath)
+func r10ProcessPart(ctx context.Context, inputPath string, fileOffset, fileSize int64, resultsCh chan partResult[*r10Stats]) {
+	start := time.Now()
+	f, err := openPart(inputPath, fileOffset, fileSize)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
-	_, err = file.Seek(fileOffset, io.SeekStart)
-	if err != nil {
+	defer f.Close()
+
+	result, processed, err := r10ProcessReader(ctx, f)
+	if err != nil && err != ctx.Err() {
 		panic(err)
 	}
-	f := io.LimitedReader{R: file, N: fileSize}
+	timings.record(phaseParse, start)
+	resultsCh <- partResult[*r10Stats]{result, byteRange{inputPath, fileOffset, f.end(processed)}, err != nil}
+}
 
-	type item struct {
-		key  []byte
-		stat *r10Stats
-	}
-	const numBuckets = 1 << 17        // number of hash buckets (power of 2)
-	items := make([]item, numBuckets) // hash buckets, linearly probed
-	size := 0                         // number of active items in items slice
+// r10ProcessReader is the core of r10: it parses complete lines from r
+// until EOF, and returns the stats per station and the number of bytes
+// processed. A final line without a trailing newline is ignored. If ctx is
+// cancelled, it stops early and returns the results so far with ctx.Err().
+func r10ProcessReader(ctx context.Context, r io.Reader) (map[string]*r10Stats, int64, error) {
+	table := newR10Table()
 
-	buf := make([]byte, 1024*1024)
+	// The buffer has 8 bytes of padding after the part we read into, so
+	// that the last few lines of a chunk can still be read a uint64 at a
+	// time (the bytes past the newline are ignored).
+	const bufSize = 1024 * 1024
+	buf := make([]byte, bufSize+8)
+	var processed int64
+	var ctxErr error
 	readStart := 0
 	for {
-		n, err := f.Read(buf[readStart:])
+		n, err := r.Read(buf[readStart:bufSize])
 		if err != nil && err != io.EOF {
-			panic(err)
+			return nil, processed, err
 		}
 		if readStart+n == 0 {
 			break
 		}
+		if ctx.Err() != nil {
+			ctxErr = ctx.Err()
+			break
+		}
 		chunk := buf[:readStart+n]
 
 		newline := bytes.LastIndexByte(chunk, '\n')
@@ -121,73 +253,126 @@ func r10ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 		}
 		remaining := chunk[newline+1:]
 		chunk = chunk[:newline+1]
+		processed += int64(len(chunk))
+		table.processChunk(chunk)
 
-	chunkLoop:
-		for {
-			var hash uint64
-			var station, after []byte
+		readStart = copy(buf, remaining)
+	}
+	return table.stats(), processed, ctxErr
+}
 
-			if len(chunk) < 8 {
-				break chunkLoop
-			}
+// r10Item is an entry in r10's hash table.
+type r10Item struct {
+	key  []byte
+	stat *r10Stats
+	name string // stationName(key)
+	skip bool   // station is rejected or doesn't pass stationFilter
+}
+
+// r10Table is the hash table of stats per station that r10's parser
+// fills in, one per worker.
+type r10Table struct {
+	items       []r10Item // hash buckets, linearly probed
+	size        int       // number of active items in items slice
+	extraValues []int32   // values of extra -columns
+}
+
+const r10NumBuckets = 1 << 17 // number of hash buckets (power of 2)
+
+func newR10Table() *r10Table {
+	return &r10Table{
+		items:       make([]r10Item, r10NumBuckets),
+		extraValues: make([]int32, max(len(valueColumns)-1, 0)),
+	}
+}
 
-			nameWord0 := binary.NativeEndian.Uint64(chunk)
-			matchBits := semicolonMatchBits(nameWord0)
-			if matchBits != 0 {
-				// semicolon is in the first 8 bytes
-				nameLen := calcNameLen(matchBits)
-				nameWord0 = maskWord(nameWord0, matchBits)
-				station = chunk[:nameLen]
-				after = chunk[nameLen+1:]
-				hash = calcHash(nameWord0)
-			} else {
-				// station name is longer so keep looking for the semicolon in
-				// uint64 chunks
-				nameLen := 8
-				hash = calcHash(nameWord0)
-				for {
-					if nameLen > len(chunk)-8 {
+// processChunk parses the lines in chunk, which ends with a newline. The
+// 8 bytes after the end of chunk must be readable (their values are
+// ignored), so that the last few lines can be read a uint64 at a time.
+func (t *r10Table) processChunk(chunk []byte) {
+	items, size, extraValues := t.items, t.size, t.extraValues
+
+chunkLoop:
+	for {
+		var hash uint64
+		var station, after []byte
+
+		if len(chunk) == 0 {
+			break chunkLoop
+		}
+
+		nameWord0 := binary.NativeEndian.Uint64(chunk[:8])
+		matchBits := semicolonMatchBits(nameWord0)
+		if matchBits != 0 {
+			// semicolon is in the first 8 bytes
+			nameLen := calcNameLen(matchBits)
+			if nameLen >= len(chunk) {
+				break chunkLoop // it's in the padding: no ';' on the last line
+			}
+			nameWord0 = maskWord(nameWord0, matchBits)
+			station = chunk[:nameLen]
+			after = chunk[nameLen+1:]
+			hash = calcHash(nameWord0)
+		} else {
+			// station name is longer so keep looking for the semicolon in
+			// uint64 chunks
+			nameLen := 8
+			hash = calcHash(nameWord0)
+			for {
+				if nameLen >= len(chunk) {
+					break chunkLoop
+				}
+				lastNameWord := binary.NativeEndian.Uint64(chunk[nameLen : nameLen+8])
+				matchBits = semicolonMatchBits(lastNameWord)
+				if matchBits != 0 {
+					nameLen += calcNameLen(matchBits)
+					if nameLen >= len(chunk) {
 						break chunkLoop
 					}
-					lastNameWord := binary.NativeEndian.Uint64(chunk[nameLen:])
-					matchBits = semicolonMatchBits(lastNameWord)
-					if matchBits != 0 {
-						nameLen += calcNameLen(matchBits)
-						station = chunk[:nameLen]
-						after = chunk[nameLen+1:]
-						break
-					}
-					nameLen += 8
+					station = chunk[:nameLen]
+					after = chunk[nameLen+1:]
+					break
 				}
+				nameLen += 8
 			}
-			index := 0
-			negative := false
-			if after[index] == '-' {
-				negative = true
-				index++
-			}
-			temp := int32(after[index] - '0')
+		}
+		index := 0
+		negative := false
+		if after[index] == '-' {
+			negative = true
 			index++
-			if after[index] != '.' {
-				temp = temp*10 + int32(after[index]-'0')
-				index++
-			}
-			index++ // skip '.'
+		}
+		temp := int32(after[index] - '0')
+		index++
+		if after[index] != '.' {
 			temp = temp*10 + int32(after[index]-'0')
-			index += 2 // skip last digit and '\n'
-			if negative {
-				temp = -temp
-			}
-			chunk = after[index:]
+			index++
+		}
+		index++ // skip '.'
+		temp = temp*10 + int32(after[index]-'0')
+		index++ // skip last digit
+		if len(extraValues) > 0 {
+			index += parseColumns(after[index:], extraValues)
+		}
+		index++ // skip '\n'
+		if negative {
+			temp = -temp
+		}
+		chunk = after[index:]
 
-			hashIndex := int(hash & (numBuckets - 1))
-			for {
-				if items[hashIndex].key == nil {
-					// Found empty slot, add new item (copying key).
-					key := make([]byte, len(station))
-					copy(key, station)
-					items[hashIndex] = item{
-						key: key,
+		hashIndex := int(hash & (r10NumBuckets - 1))
+		for {
+			if items[hashIndex].key == nil {
+				// Found empty slot, add new item (copying key).
+				key := make([]byte, len(station))
+				copy(key, station)
+				name, ok := stationName(key)
+				if !ok || (stationFilter != nil && !stationFilter(name)) {
+					items[hashIndex] = r10Item{key: key, name: name, skip: true}
+				} else {
+					items[hashIndex] = r10Item{
+						key:  key,
+						name: name,
 						stat: &r10Stats{
 							min:   temp,
 							max:   temp,
@@ -195,40 +380,62 @@ func r10ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 							count: 1,
 						},
 					}
-					size++
-					if size > numBuckets/2 {
-						panic("too many items in hash table")
+					if collectHist {
+						items[hashIndex].stat.hist = make([]int64, histSize)
+						items[hashIndex].stat.hist[temp+histOffset]++
 					}
-					break
+					if len(extraValues) > 0 {
+						items[hashIndex].stat.cols = newColumns(extraValues)
+					}
+				}
+				size++
+				if size > r10NumBuckets/2 {
+					panic(errTooManyStations)
 				}
-				if bytes.Equal(items[hashIndex].key, station) {
-					// Found matching slot, add to existing stats.
-					s := items[hashIndex].stat
-					s.min = min(s.min, temp)
-					s.max = max(s.max, temp)
-					s.sum += int64(temp)
-					s.count++
+				break
+			}
+			if bytes.Equal(items[hashIndex].key, station) {
+				// Found matching slot, add to existing stats.
+				if items[hashIndex].skip {
 					break
 				}
-				// Slot already holds another key, try next slot (linear probe).
-				hashIndex++
-				if hashIndex >= numBuckets {
-					hashIndex = 0
+				s := items[hashIndex].stat
+				s.min = min(s.min, temp)
+				s.max = max(s.max, temp)
+				s.sum += int64(temp)
+				s.count++
+				if s.hist != nil {
+					s.hist[temp+histOffset]++
 				}
+				if s.cols != nil {
+					addColumns(s.cols, extraValues)
+				}
+				break
+			}
+			// Slot already holds another key, try next slot (linear probe).
+			hashIndex++
+			if hashIndex >= r10NumBuckets {
+				hashIndex = 0
 			}
 		}
-
-		readStart = copy(buf, remaining)
 	}
+	t.size = size
+}
 
-	result := make(map[string]*r10Stats, size)
-	for _, item := range items {
-		if item.key == nil {
+// stats returns the stats per station name.
+func (t *r10Table) stats() map[string]*r10Stats {
+	result := make(map[string]*r10Stats, t.size)
+	for _, item := range t.items {
+		if item.key == nil || item.skip {
+			continue
+		}
+		if s := result[item.name]; s != nil {
+			s.merge(item.stat) // another key normalized to the same name
 			continue
 		}
-		result[string(item.key)] = item.stat
+		result[item.name] = item.stat
 	}
-	resultsCh <- result
+	return result
 }
 
 func calcNameLen(b uint64) int {
@@ -7,29 +7,40 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"os"
-	"sort"
+	"time"
 )
 
-func r4(inputPath string, output io.Writer) error {
+func r4(ctx context.Context, inputPaths []string, output io.Writer) error {
 	type stats struct {
 		min, max, count int32
 		sum             int64
 	}
 
-	f, err := os.Open(inputPath)
+	f, err := openInputs(inputPaths)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	mark := time.Now()
 	stationStats := make(map[string]*stats)
 
+	var processed int64
+	nextCheck := int64(cancelCheckBytes)
+	stopped := false
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
+		if processed >= nextCheck {
+			if ctx.Err() != nil {
+				stopped = true
+				break
+			}
+			nextCheck += cancelCheckBytes
+		}
 		line := scanner.Bytes()
+		processed += int64(len(line)) + 1
 		station, tempBytes, hasSemi := bytes.Cut(line, []byte(";"))
 		if !hasSemi {
 			continue
@@ -69,21 +80,24 @@ func r4(inputPath string, output io.Writer) error {
 		}
 	}
 
-	stations := make([]string, 0, len(stationStats))
-	for station := range stationStats {
-		stations = append(stations, station)
-	}
-	sort.Strings(stations)
+	mark = timings.record(phaseParse, mark)
 
-	fmt.Fprint(output, "{")
-	for i, station := range stations {
-		if i > 0 {
-			fmt.Fprint(output, ", ")
-		}
-		s := stationStats[station]
-		mean := float64(s.sum) / float64(s.count) / 10
-		fmt.Fprintf(output, "%s=%.1f/%.1f/%.1f", station, float64(s.min)/10, mean, float64(s.max)/10)
+	results := make([]stationResult, 0, len(stationStats))
+	for station, s := range stationStats {
+		results = append(results, stationResult{
+			station: station,
+			min:     s.min,
+			max:     s.max,
+			sum:     s.sum,
+			count:   int64(s.count),
+		})
+	}
+	err = outputResults(output, results)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), f.ranges(processed)}
 	}
-	fmt.Fprint(output, "}\n")
 	return nil
 }
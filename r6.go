@@ -6,26 +6,28 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"os"
-	"sort"
+	"time"
 )
 
-func r6(inputPath string, output io.Writer) error {
+func r6(ctx context.Context, inputPaths []string, output io.Writer) error {
 	type stats struct {
 		min, max, count int32
 		sum             int64
 	}
 
-	f, err := os.Open(inputPath)
+	f, err := openInputs(inputPaths)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	mark := time.Now()
 	stationStats := make(map[string]*stats)
 
+	var processed int64
+	stopped := false
 	buf := make([]byte, 1024*1024)
 	readStart := 0
 	for {
@@ -36,6 +38,10 @@ func r6(inputPath string, output io.Writer) error {
 		if readStart+n == 0 {
 			break
 		}
+		if ctx.Err() != nil {
+			stopped = true
+			break
+		}
 		chunk := buf[:readStart+n]
 
 		newline := bytes.LastIndexByte(chunk, '\n')
@@ -44,6 +50,7 @@ func r6(inputPath string, output io.Writer) error {
 		}
 		remaining := chunk[newline+1:]
 		chunk = chunk[:newline+1]
+		processed += int64(len(chunk))
 
 		for {
 			station, after, hasSemi := bytes.Cut(chunk, []byte(";"))
@@ -90,21 +97,24 @@ func r6(inputPath string, output io.Writer) error {
 		readStart = copy(buf, remaining)
 	}
 
-	stations := make([]string, 0, len(stationStats))
-	for station := range stationStats {
-		stations = append(stations, station)
-	}
-	sort.Strings(stations)
+	mark = timings.record(phaseParse, mark)
 
-	fmt.Fprint(output, "{")
-	for i, station := range stations {
-		if i > 0 {
-			fmt.Fprint(output, ", ")
-		}
-		s := stationStats[station]
-		mean := float64(s.sum) / float64(s.count) / 10
-		fmt.Fprintf(output, "%s=%.1f/%.1f/%.1f", station, float64(s.min)/10, mean, float64(s.max)/10)
+	results := make([]stationResult, 0, len(stationStats))
+	for station, s := range stationStats {
+		results = append(results, stationResult{
+			station: station,
+			min:     s.min,
+			max:     s.max,
+			sum:     s.sum,
+			count:   int64(s.count),
+		})
+	}
+	err = outputResults(output, results)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), f.ranges(processed)}
 	}
-	fmt.Fprint(output, "}\n")
 	return nil
 }
@@ -6,24 +6,24 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"os"
-	"sort"
+	"time"
 )
 
-func r7(inputPath string, output io.Writer) error {
+func r7(ctx context.Context, inputPaths []string, output io.Writer) error {
 	type stats struct {
 		min, max, count int32
 		sum             int64
 	}
 
-	f, err := os.Open(inputPath)
+	f, err := openInputs(inputPaths)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	mark := time.Now()
 	type item struct {
 		key  []byte
 		stat *stats
@@ -32,6 +32,8 @@ func r7(inputPath string, output io.Writer) error {
 	items := make([]item, numBuckets) // hash buckets, linearly probed
 	size := 0                         // number of active items in items slice
 
+	var processed int64
+	stopped := false
 	buf := make([]byte, 1024*1024)
 	readStart := 0
 	for {
@@ -42,6 +44,10 @@ func r7(inputPath string, output io.Writer) error {
 		if readStart+n == 0 {
 			break
 		}
+		if ctx.Err() != nil {
+			stopped = true
+			break
+		}
 		chunk := buf[:readStart+n]
 
 		newline := bytes.LastIndexByte(chunk, '\n')
@@ -50,6 +56,7 @@ func r7(inputPath string, output io.Writer) error {
 		}
 		remaining := chunk[newline+1:]
 		chunk = chunk[:newline+1]
+		processed += int64(len(chunk))
 
 		for {
 			const (
@@ -136,26 +143,28 @@ func r7(inputPath string, output io.Writer) error {
 		readStart = copy(buf, remaining)
 	}
 
-	stationItems := make([]item, 0, size)
+	mark = timings.record(phaseParse, mark)
+
+	results := make([]stationResult, 0, size)
 	for _, item := range items {
 		if item.key == nil {
 			continue
 		}
-		stationItems = append(stationItems, item)
-	}
-	sort.Slice(stationItems, func(i, j int) bool {
-		return string(stationItems[i].key) < string(stationItems[j].key)
-	})
-
-	fmt.Fprint(output, "{")
-	for i, item := range stationItems {
-		if i > 0 {
-			fmt.Fprint(output, ", ")
-		}
 		s := item.stat
-		mean := float64(s.sum) / float64(s.count) / 10
-		fmt.Fprintf(output, "%s=%.1f/%.1f/%.1f", item.key, float64(s.min)/10, mean, float64(s.max)/10)
+		results = append(results, stationResult{
+			station: string(item.key),
+			min:     s.min,
+			max:     s.max,
+			sum:     s.sum,
+			count:   int64(s.count),
+		})
+	}
+	err = outputResults(output, results)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), f.ranges(processed)}
 	}
-	fmt.Fprint(output, "}\n")
 	return nil
 }
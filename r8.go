@@ -6,13 +6,12 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type r8Stats struct {
@@ -20,75 +19,116 @@ type r8Stats struct {
 	count         int64
 }
 
-func r8(inputPath string, output io.Writer) error {
-	parts, err := splitFile(inputPath, maxGoroutines)
+func r8(ctx context.Context, inputPaths []string, output io.Writer) error {
+	if checkpointDir != "" {
+		return runCheckpointed(ctx, inputPaths, output, func(p part, resultsCh chan partResult[r8Stats]) {
+			r8ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+		}, r8Results)
+	}
+
+	mark := time.Now()
+	parts, err := splitFiles(inputPaths, maxGoroutines)
 	if err != nil {
 		return err
 	}
+	timings.record(phaseSplit, mark)
 
-	resultsCh := make(chan map[string]r8Stats)
-	for _, part := range parts {
-		go r8ProcessPart(inputPath, part.offset, part.size, resultsCh)
-	}
+	resultsCh := make(chan partResult[r8Stats])
+	runParts(parts, func(p part) {
+		r8ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+	})
 
+	var covered []byteRange
+	stopped := false
 	totals := make(map[string]r8Stats)
+	fileTotals := make(map[string]map[string]r8Stats)
 	for i := 0; i < len(parts); i++ {
 		result := <-resultsCh
-		for station, s := range result {
-			ts, ok := totals[station]
-			if !ok {
-				totals[station] = r8Stats{
-					min:   s.min,
-					max:   s.max,
-					sum:   s.sum,
-					count: s.count,
-				}
-				continue
+		mergeStart := time.Now()
+		covered = append(covered, result.covered)
+		stopped = stopped || result.stopped
+		if perFile {
+			path := result.covered.path
+			if fileTotals[path] == nil {
+				fileTotals[path] = make(map[string]r8Stats)
 			}
-			ts.min = min(ts.min, s.min)
-			ts.max = max(ts.max, s.max)
-			ts.sum += s.sum
-			ts.count += s.count
-			totals[station] = ts
+			r8Merge(fileTotals[path], result.stats)
 		}
+		r8Merge(totals, result.stats)
+		timings.record(phaseMerge, mergeStart)
 	}
 
-	stations := make([]string, 0, len(totals))
-	for station := range totals {
-		stations = append(stations, station)
+	if perFile {
+		for _, path := range inputPaths {
+			fmt.Fprintf(output, "%s: ", path)
+			writeResults(output, r8Results(fileTotals[path]), outputFormat)
+		}
 	}
-	sort.Strings(stations)
+	err = outputResults(output, r8Results(totals))
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), covered}
+	}
+	return nil
+}
 
-	fmt.Fprint(output, "{")
-	for i, station := range stations {
-		if i > 0 {
-			fmt.Fprint(output, ", ")
+// r8Merge adds the per-station stats from result into totals.
+func r8Merge(totals, result map[string]r8Stats) {
+	for station, s := range result {
+		ts, ok := totals[station]
+		if !ok {
+			totals[station] = s
+			continue
 		}
-		s := totals[station]
-		mean := s.sum / float64(s.count)
-		fmt.Fprintf(output, "%s=%.1f/%.1f/%.1f", station, s.min, mean, s.max)
+		ts.min = min(ts.min, s.min)
+		ts.max = max(ts.max, s.max)
+		ts.sum += s.sum
+		ts.count += s.count
+		totals[station] = ts
 	}
-	fmt.Fprint(output, "}\n")
-	return nil
 }
 
-func r8ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan map[string]r8Stats) {
-	file, err := os.Open(inputPath)
-	if err != nil {
-		panic(err)
+// r8Results converts totals to results for the output stage.
+func r8Results(totals map[string]r8Stats) []stationResult {
+	results := make([]stationResult, 0, len(totals))
+	for station, s := range totals {
+		results = append(results, stationResult{
+			station: station,
+			min:     int32(tenths(s.min)),
+			max:     int32(tenths(s.max)),
+			sum:     tenths(s.sum),
+			count:   s.count,
+		})
 	}
-	defer file.Close()
-	_, err = file.Seek(fileOffset, io.SeekStart)
+	return results
+}
+
+func r8ProcessPart(ctx context.Context, inputPath string, fileOffset, fileSize int64, resultsCh chan partResult[r8Stats]) {
+	start := time.Now()
+	f, err := openPart(inputPath, fileOffset, fileSize)
 	if err != nil {
 		panic(err)
 	}
-	f := io.LimitedReader{R: file, N: fileSize}
+	defer f.Close()
 
 	stationStats := make(map[string]r8Stats)
 
-	scanner := bufio.NewScanner(&f)
+	var processed int64
+	nextCheck := int64(cancelCheckBytes)
+	stopped := false
+	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
+		if processed >= nextCheck {
+			if ctx.Err() != nil {
+				stopped = true
+				break
+			}
+			nextCheck += cancelCheckBytes
+		}
 		line := scanner.Text()
+		processed += int64(len(line)) + 1
 		station, tempStr, hasSemi := strings.Cut(line, ";")
 		if !hasSemi {
 			continue
@@ -114,53 +154,50 @@ func r8ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 		stationStats[station] = s
 	}
 
-	resultsCh <- stationStats
+	timings.record(phaseParse, start)
+	resultsCh <- partResult[r8Stats]{stationStats, byteRange{inputPath, fileOffset, f.end(processed)}, stopped}
 }
 
 type part struct {
+	path         string
 	offset, size int64
 }
 
 func splitFile(inputPath string, numParts int) ([]part, error) {
 	const maxLineLength = 100
 
-	f, err := os.Open(inputPath)
-	if err != nil {
-		return nil, err
-	}
-	st, err := f.Stat()
+	f, size, enc, err := openEncoding(inputPath)
 	if err != nil {
 		return nil, err
 	}
-	size := st.Size()
-	splitSize := size / int64(numParts)
+	defer f.Close()
+	splitSize := (size - enc.bom) / int64(numParts)
 
-	buf := make([]byte, maxLineLength)
+	buf := make([]byte, maxLineLength*len(enc.newline()))
 
 	parts := make([]part, 0, numParts)
-	offset := int64(0)
+	offset := enc.bom
 	for i := 0; i < numParts; i++ {
 		if i == numParts-1 {
 			if offset < size {
-				parts = append(parts, part{offset, size - offset})
+				parts = append(parts, part{inputPath, offset, size - offset})
 			}
 			break
 		}
 
-		seekOffset := max(offset+splitSize-maxLineLength, 0)
+		seekOffset := max(offset+splitSize-int64(len(buf)), enc.bom)
 		_, err := f.Seek(seekOffset, io.SeekStart)
 		if err != nil {
 			return nil, err
 		}
 		n, _ := io.ReadFull(f, buf)
 		chunk := buf[:n]
-		newline := bytes.LastIndexByte(chunk, '\n')
-		if newline < 0 {
-			return nil, fmt.Errorf("newline not found at offset %d", offset+splitSize-maxLineLength)
+		lineEnd := enc.lastNewline(chunk, seekOffset)
+		if lineEnd < 0 {
+			return nil, fmt.Errorf("newline not found at offset %d", seekOffset)
 		}
-		remaining := len(chunk) - newline - 1
-		nextOffset := seekOffset + int64(len(chunk)) - int64(remaining)
-		parts = append(parts, part{offset, nextOffset - offset})
+		nextOffset := seekOffset + int64(lineEnd)
+		parts = append(parts, part{inputPath, offset, nextOffset - offset})
 		offset = nextOffset
 	}
 	return parts, nil
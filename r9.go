@@ -6,10 +6,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"os"
-	"sort"
+	"time"
 )
 
 type r9Stats struct {
@@ -17,72 +17,113 @@ type r9Stats struct {
 	sum             int64
 }
 
-func r9(inputPath string, output io.Writer) error {
-	parts, err := splitFile(inputPath, maxGoroutines)
+func r9(ctx context.Context, inputPaths []string, output io.Writer) error {
+	if checkpointDir != "" {
+		return runCheckpointed(ctx, inputPaths, output, func(p part, resultsCh chan partResult[*r9Stats]) {
+			r9ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+		}, r9Results)
+	}
+
+	mark := time.Now()
+	parts, err := splitFiles(inputPaths, maxGoroutines)
 	if err != nil {
 		return err
 	}
+	timings.record(phaseSplit, mark)
 
-	resultsCh := make(chan map[string]*r9Stats)
-	for _, part := range parts {
-		go r9ProcessPart(inputPath, part.offset, part.size, resultsCh)
-	}
+	resultsCh := make(chan partResult[*r9Stats])
+	runParts(parts, func(p part) {
+		r9ProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+	})
 
+	var covered []byteRange
+	stopped := false
 	totals := make(map[string]*r9Stats)
+	fileTotals := make(map[string]map[string]*r9Stats)
 	for i := 0; i < len(parts); i++ {
 		result := <-resultsCh
-		for station, s := range result {
-			ts := totals[station]
-			if ts == nil {
-				totals[station] = s
-				continue
+		mergeStart := time.Now()
+		covered = append(covered, result.covered)
+		stopped = stopped || result.stopped
+		if perFile {
+			path := result.covered.path
+			if fileTotals[path] == nil {
+				fileTotals[path] = make(map[string]*r9Stats)
 			}
-			ts.min = min(ts.min, s.min)
-			ts.max = max(ts.max, s.max)
-			ts.sum += s.sum
-			ts.count += s.count
+			r9Merge(fileTotals[path], result.stats)
 		}
+		r9Merge(totals, result.stats)
+		timings.record(phaseMerge, mergeStart)
 	}
 
-	stations := make([]string, 0, len(totals))
-	for station := range totals {
-		stations = append(stations, station)
+	if perFile {
+		for _, path := range inputPaths {
+			fmt.Fprintf(output, "%s: ", path)
+			writeResults(output, r9Results(fileTotals[path]), outputFormat)
+		}
 	}
-	sort.Strings(stations)
+	err = outputResults(output, r9Results(totals))
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), covered}
+	}
+	return nil
+}
 
-	fmt.Fprint(output, "{")
-	for i, station := range stations {
-		if i > 0 {
-			fmt.Fprint(output, ", ")
+// r9Merge adds the per-station stats from result into totals, copying
+// new entries so that totals never shares stats with a part's result.
+func r9Merge(totals, result map[string]*r9Stats) {
+	for station, s := range result {
+		ts := totals[station]
+		if ts == nil {
+			c := *s
+			totals[station] = &c
+			continue
 		}
-		s := totals[station]
-		mean := float64(s.sum) / float64(s.count) / 10
-		fmt.Fprintf(output, "%s=%.1f/%.1f/%.1f", station, float64(s.min)/10, mean, float64(s.max)/10)
+		ts.min = min(ts.min, s.min)
+		ts.max = max(ts.max, s.max)
+		ts.sum += s.sum
+		ts.count += s.count
 	}
-	fmt.Fprint(output, "}\n")
-	return nil
 }
 
-func r9ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan map[string]*r9Stats) {
-	file, err := os.Open(inputPath)
-	if err != nil {
-		panic(err)
+// r9Results converts totals to results for the output stage.
+func r9Results(totals map[string]*r9Stats) []stationResult {
+	results := make([]stationResult, 0, len(totals))
+	for station, s := range totals {
+		results = append(results, stationResult{
+			station: station,
+			min:     s.min,
+			max:     s.max,
+			sum:     s.sum,
+			count:   int64(s.count),
+		})
 	}
-	defer file.Close()
-	_, err = file.Seek(fileOffset, io.SeekStart)
+	return results
+}
+
+func r9ProcessPart(ctx context.Context, inputPath string, fileOffset, fileSize int64, resultsCh chan partResult[*r9Stats]) {
+	start := time.Now()
+	f, err := openPart(inputPath, fileOffset, fileSize)
 	if err != nil {
 		panic(err)
 	}
-	f := io.LimitedReader{R: file, N: fileSize}
+	defer f.Close()
 
 	type item struct {
 		key  []byte
 		stat *r9Stats
+		name string // stationName(key)
+		skip bool   // station is rejected or doesn't pass stationFilter
 	}
 	const numBuckets = 1 << 17        // number of hash buckets (power of 2)
 	items := make([]item, numBuckets) // hash buckets, linearly probed
 	size := 0                         // number of active items in items slice
 
+	var processed int64
+	stopped := false
 	buf := make([]byte, 1024*1024)
 	readStart := 0
 	for {
@@ -93,6 +134,10 @@ func r9ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 		if readStart+n == 0 {
 			break
 		}
+		if ctx.Err() != nil {
+			stopped = true
+			break
+		}
 		chunk := buf[:readStart+n]
 
 		newline := bytes.LastIndexByte(chunk, '\n')
@@ -101,6 +146,7 @@ func r9ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 		}
 		remaining := chunk[newline+1:]
 		chunk = chunk[:newline+1]
+		processed += int64(len(chunk))
 
 		for {
 			const (
@@ -152,14 +198,20 @@ func r9ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 					// Found empty slot, add new item (copying key).
 					key := make([]byte, len(station))
 					copy(key, station)
-					items[hashIndex] = item{
-						key: key,
-						stat: &r9Stats{
-							min:   temp,
-							max:   temp,
-							sum:   int64(temp),
-							count: 1,
-						},
+					name, ok := stationName(key)
+					if !ok || (stationFilter != nil && !stationFilter(name)) {
+						items[hashIndex] = item{key: key, name: name, skip: true}
+					} else {
+						items[hashIndex] = item{
+							key:  key,
+							name: name,
+							stat: &r9Stats{
+								min:   temp,
+								max:   temp,
+								sum:   int64(temp),
+								count: 1,
+							},
+						}
 					}
 					size++
 					if size > numBuckets/2 {
@@ -169,6 +221,9 @@ func r9ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 				}
 				if bytes.Equal(items[hashIndex].key, station) {
 					// Found matching slot, add to existing stats.
+					if items[hashIndex].skip {
+						break
+					}
 					s := items[hashIndex].stat
 					s.min = min(s.min, temp)
 					s.max = max(s.max, temp)
@@ -189,10 +244,19 @@ func r9ProcessPart(inputPath string, fileOffset, fileSize int64, resultsCh chan
 
 	result := make(map[string]*r9Stats, size)
 	for _, item := range items {
-		if item.key == nil {
+		if item.key == nil || item.skip {
+			continue
+		}
+		if s := result[item.name]; s != nil {
+			// Another key normalized to the same name.
+			s.min = min(s.min, item.stat.min)
+			s.max = max(s.max, item.stat.max)
+			s.sum += item.stat.sum
+			s.count += item.stat.count
 			continue
 		}
-		result[string(item.key)] = item.stat
+		result[item.name] = item.stat
 	}
-	resultsCh <- result
+	timings.record(phaseParse, start)
+	resultsCh <- partResult[*r9Stats]{result, byteRange{inputPath, fileOffset, f.end(processed)}, stopped}
 }
@@ -0,0 +1,79 @@
+// Top-N and bottom-N selection: with -top=N or -bottom=N, only the N
+// stations with the highest (or lowest) value of -by are output
+
+package main
+
+import "container/heap"
+
+// rankN, rankBottom and rankBy are set by -top, -bottom and -by.
+var (
+	rankN      int
+	rankBottom bool
+	rankBy     = "mean"
+)
+
+var rankFields = []string{"mean", "max", "min", "count", "range"}
+
+// rankValue returns the value of r that results are ranked by.
+func rankValue(r stationResult, by string) float64 {
+	switch by {
+	case "max":
+		return float64(r.max)
+	case "min":
+		return float64(r.min)
+	case "count":
+		return float64(r.count)
+	case "range":
+		return float64(r.max - r.min)
+	default:
+		return r.mean()
+	}
+}
+
+// rankHeap is a heap of the best results seen so far, with the worst at
+// the root so it can be replaced when a better one comes along.
+type rankHeap struct {
+	results []stationResult
+	better  func(a, b stationResult) bool
+}
+
+func (h *rankHeap) Len() int           { return len(h.results) }
+func (h *rankHeap) Less(i, j int) bool { return h.better(h.results[j], h.results[i]) }
+func (h *rankHeap) Swap(i, j int)      { h.results[i], h.results[j] = h.results[j], h.results[i] }
+func (h *rankHeap) Push(x any)         { h.results = append(h.results, x.(stationResult)) }
+func (h *rankHeap) Pop() any {
+	n := len(h.results) - 1
+	r := h.results[n]
+	h.results = h.results[:n]
+	return r
+}
+
+// selectRanked returns the n results with the highest values of by (or
+// the lowest if bottom is true), best first. It uses a heap of size n
+// rather than sorting all the results, as n is usually much smaller.
+func selectRanked(results []stationResult, n int, by string, bottom bool) []stationResult {
+	// Ties are broken by station name so the selection doesn't depend on
+	// the order of the results.
+	better := func(a, b stationResult) bool {
+		va, vb := rankValue(a, by), rankValue(b, by)
+		if va != vb {
+			return (va > vb) != bottom
+		}
+		return a.station < b.station
+	}
+	h := &rankHeap{better: better}
+	for _, r := range results {
+		if len(h.results) < n {
+			heap.Push(h, r)
+		} else if better(r, h.results[0]) {
+			h.results[0] = r
+			heap.Fix(h, 0)
+		}
+	}
+
+	selected := make([]stationResult, len(h.results))
+	for i := len(selected) - 1; i >= 0; i-- {
+		selected[i] = heap.Pop(h).(stationResult)
+	}
+	return selected
+}
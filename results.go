@@ -0,0 +1,284 @@
+// Output stage shared by all revisions: sorting and formatting of results
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// outputFormat is set by -format; see writeResults for the choices.
+var outputFormat = "text"
+
+var outputFormats = []string{"text", "json", "prometheus"}
+
+// stationResult is the final aggregate for one station, as passed to the
+// output stage. Temperatures are fixed point tenths of a degree as in r4
+// onwards; the float64 revisions convert using tenths().
+type stationResult struct {
+	station  string
+	window   int64 // start of the time window in Unix seconds, with -window
+	min, max int32
+	sum      int64
+	count    int64
+	hist     map[int32]int64 // count of readings per temperature, if collected
+	cols     []columnStats   // stats for the extra -columns, if any
+}
+
+// key returns the key that identifies r when merging results: the station
+// name, plus the window start when aggregating by time window.
+func (r stationResult) key() string {
+	if windowSize == 0 {
+		return r.station
+	}
+	return windowMapKey([]byte(r.station), r.window)
+}
+
+// name returns the name r is output with: the station name, followed by
+// "@" and the window start when aggregating by time window.
+func (r stationResult) name() string {
+	if windowSize == 0 {
+		return r.station
+	}
+	return r.station + "@" + windowStart(r)
+}
+
+func (r stationResult) mean() float64 {
+	return float64(r.sum) / float64(r.count) / 10
+}
+
+// tenths converts a float64 temperature to fixed point tenths.
+func tenths(f float64) int64 {
+	return int64(math.Round(f * 10))
+}
+
+// outputResults is the final output stage for a revision's merged
+// results. It merges stations whose names normalize the same, drops
+// stations excluded by -station, -prefix and -match, captures the results
+// for the result cache if that's in use, discards readings excluded by
+// -minval, -maxval and -outliers, and then writes the results to output
+// in the -format chosen, and to the -snapshot file if that's set.
+func outputResults(output io.Writer, results []stationResult) error {
+	results = filterResults(normalizeResults(results))
+	if captureResults {
+		capturedResults = results
+	}
+	results, discarded := rejectReadings(results)
+	if snapshotPath != "" {
+		err := writeFileAtomic(snapshotPath, func(w io.Writer) error {
+			return encodeSnapshot(w, results)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	rows := writeResults(output, results, outputFormat)
+	timings.count(rows, len(results))
+	writeDiscarded(os.Stderr, discarded)
+	return nil
+}
+
+// writeResults writes results to output in the given format, which is
+// one of:
+//
+//   - "text": the standard 1BRC {station=min/mean/max, ...} format, with
+//     ";min/mean/max" added for each extra value column
+//   - "json": an array of objects with station, min, mean, max and count
+//     (and the extra columns' stats)
+//   - "prometheus": gauges in the Prometheus text exposition format
+//
+// Stations whose names normalize the same with -normalize or -fold are
+// merged, stations excluded by -station, -prefix and -match are dropped,
+// and with -groupby the rest are rolled up into groups (preceded by each
+// group's stations with -leaves). The results are sorted as set by -sort,
+// -desc and -collate, or with -top or -bottom just those stations are
+// selected, in rank order. It returns the total number of rows all the
+// results cover.
+func writeResults(output io.Writer, results []stationResult, format string) int64 {
+	results = filterResults(normalizeResults(results))
+	if groupKey != nil {
+		var leaves map[string][]stationResult
+		results, leaves = groupResults(results)
+		if groupLeaves {
+			groups := make([]string, 0, len(leaves))
+			for group := range leaves {
+				groups = append(groups, group)
+			}
+			sortNames(groups)
+			for _, group := range groups {
+				fmt.Fprintf(output, "%s: ", group)
+				writeSorted(output, leaves[group], format)
+			}
+		}
+	}
+	return writeSorted(output, results, format)
+}
+
+// writeSorted sorts or ranks results and writes them in format.
+func writeSorted(output io.Writer, results []stationResult, format string) int64 {
+	var rows int64
+	for _, r := range results {
+		rows += r.count
+	}
+
+	mark := time.Now()
+	if rankN > 0 {
+		results = selectRanked(results, rankN, rankBy, rankBottom)
+	} else {
+		results = sortResults(results)
+	}
+	mark = timings.record(phaseSort, mark)
+
+	switch format {
+	case "json":
+		writeJSON(output, results)
+	case "prometheus":
+		writePrometheus(output, results)
+	default:
+		writeText(output, results)
+	}
+	timings.record(phaseFormat, mark)
+	return rows
+}
+
+func writeText(output io.Writer, results []stationResult) {
+	fmt.Fprint(output, "{")
+	for i, r := range results {
+		if i > 0 {
+			fmt.Fprint(output, ", ")
+		}
+		fmt.Fprintf(output, "%s=%s/%s/%s", r.name(),
+			formatTemp(int64(r.min), 1), formatTemp(r.sum, r.count), formatTemp(int64(r.max), 1))
+		for _, c := range r.cols {
+			fmt.Fprintf(output, ";%.1f/%.1f/%.1f", float64(c.min)/10, float64(c.sum)/float64(r.count)/10, float64(c.max)/10)
+		}
+	}
+	fmt.Fprint(output, "}\n")
+}
+
+// windowStart returns the start of r's time window as an RFC 3339 time,
+// or "" if not aggregating by time window.
+func windowStart(r stationResult) string {
+	if windowSize == 0 {
+		return ""
+	}
+	return time.Unix(r.window, 0).UTC().Format(time.RFC3339)
+}
+
+// jsonResult is the JSON form of a single station's result.
+type jsonResult struct {
+	Station string       `json:"station"`
+	Window  string       `json:"window,omitempty"` // RFC 3339 start time
+	Min     json.Number  `json:"min"`
+	Mean    json.Number  `json:"mean"`
+	Max     json.Number  `json:"max"`
+	Count   int64        `json:"count"`
+	Columns []jsonColumn `json:"columns,omitempty"` // extra -columns
+}
+
+// jsonColumn is the JSON form of an extra value column's stats.
+type jsonColumn struct {
+	Name string      `json:"name"`
+	Min  json.Number `json:"min"`
+	Mean json.Number `json:"mean"`
+	Max  json.Number `json:"max"`
+}
+
+// writeJSON writes results as a JSON array. Numbers are formatted the same
+// way as the text output.
+func writeJSON(output io.Writer, results []stationResult) {
+	format := func(f float64) json.Number {
+		return json.Number(strconv.FormatFloat(f, 'f', 1, 64))
+	}
+	jsonResults := make([]jsonResult, len(results))
+	for i, r := range results {
+		jsonResults[i] = jsonResult{
+			Station: r.station,
+			Window:  windowStart(r),
+			Min:     json.Number(formatTemp(int64(r.min), 1)),
+			Mean:    json.Number(formatTemp(r.sum, r.count)),
+			Max:     json.Number(formatTemp(int64(r.max), 1)),
+			Count:   r.count,
+		}
+		for j, c := range r.cols {
+			jsonResults[i].Columns = append(jsonResults[i].Columns, jsonColumn{
+				Name: columnName(j),
+				Min:  format(float64(c.min) / 10),
+				Mean: format(float64(c.sum) / float64(r.count) / 10),
+				Max:  format(float64(c.max) / 10),
+			})
+		}
+	}
+	json.NewEncoder(output).Encode(jsonResults)
+}
+
+// writePrometheus writes results as station_temperature_* gauges, one
+// metric family at a time as the exposition format requires.
+func writePrometheus(output io.Writer, results []stationResult) {
+	w := bufio.NewWriter(output)
+	defer w.Flush()
+
+	labels := make([]string, len(results))
+	for i, r := range results {
+		labels[i] = escapeLabelValue(r.station)
+	}
+
+	families := []struct {
+		name, help string
+		value      func(r stationResult) string
+	}{
+		{"station_temperature_min", "Minimum temperature at the station.", func(r stationResult) string {
+			return formatTemp(int64(r.min), 1)
+		}},
+		{"station_temperature_max", "Maximum temperature at the station.", func(r stationResult) string {
+			return formatTemp(int64(r.max), 1)
+		}},
+		{"station_temperature_mean", "Mean temperature at the station.", func(r stationResult) string {
+			return strconv.FormatFloat(tempValue(r.sum, r.count), 'g', -1, 64)
+		}},
+		{"station_temperature_count", "Number of readings from the station.", func(r stationResult) string {
+			return strconv.FormatInt(r.count, 10)
+		}},
+	}
+	for _, family := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", family.name)
+		for i, r := range results {
+			fmt.Fprintf(w, "%s{station=\"%s\"} %s\n", family.name, labels[i], family.value(r))
+		}
+	}
+}
+
+// escapeLabelValue escapes a Prometheus label value: backslash, double
+// quote and newline are backslash-escaped, and invalid UTF-8 (which the
+// format doesn't allow) is replaced with U+FFFD.
+func escapeLabelValue(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	if !strings.ContainsAny(s, "\\\"\n") {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
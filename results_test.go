@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestEscapeLabelValue(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"Hamburg", "Hamburg"},
+		{"São Paulo", "São Paulo"},
+		{`A "quoted" name`, `A \"quoted\" name`},
+		{`back\slash`, `back\\slash`},
+		{"new\nline", `new\nline`},
+		{"bad\xffbyte", "bad�byte"},
+	}
+	for _, test := range tests {
+		got := escapeLabelValue(test.input)
+		if got != test.want {
+			t.Errorf("escapeLabelValue(%q): want %q, got %q", test.input, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Registry of the revisions of the solution, so they can be listed and
+// selected by name, and new ones added without renumbering
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type revisionFunc func(context.Context, []string, io.Writer) error
+
+// capability is a set of optional features a revision supports.
+type capability int
+
+const (
+	capPerFile     capability = 1 << iota // -perfile
+	capCheckpoint                         // -checkpoint
+	capHistograms                         // -minval, -maxval and -outliers
+	capColumns                            // -columns
+	capFollow                             // -follow
+	capIncremental                        // -incremental
+	capWindow                             // -window (the only thing it supports)
+)
+
+// capabilities are the names of the capabilities for -list, and the
+// options that need them, in the order of the constants above.
+var capabilities = []struct{ name, options string }{
+	{"perfile", "-perfile"},
+	{"checkpoint", "-checkpoint"},
+	{"histograms", "-minval, -maxval and -outliers"},
+	{"columns", "-columns"},
+	{"follow", "-follow"},
+	{"incremental", "-incremental"},
+	{"window", "-window"},
+}
+
+// revision is one implementation of the solution.
+type revision struct {
+	name        string
+	aliases     []string // other names it can be selected by
+	description string
+	parallel    bool
+	caps        capability
+	run         revisionFunc
+}
+
+// revisions are in the order they were written, which is the order
+// -benchall runs them in. The numbered ones are the original steps; others
+// may be added by platform-specific files.
+var revisions = []revision{
+	{"r1", []string{"simple"}, "simple, idiomatic Go using bufio.Scanner and strconv.ParseFloat", false, 0, r1},
+	{"r2", nil, "use stats pointer as map value to avoid double hashing", false, 0, r2},
+	{"r3", nil, "parse temperatures manually instead of using strconv.ParseFloat", false, 0, r3},
+	{"r4", []string{"fixedpoint"}, "use fixed point int32s (*10) instead of float64s", false, 0, r4},
+	{"r5", nil, "avoid bytes.Cut", false, 0, r5},
+	{"r6", nil, "don't use bufio.Scanner to avoid scanning some bytes twice", false, 0, r6},
+	{"r7", []string{"hashtable"}, "use custom hash table and hash station name as we look for ';'", false, 0, r7},
+	{"r8", []string{"parallel"}, "add some parallelism (but back to non-optimized r1 version)", true, capPerFile | capCheckpoint, r8},
+	{"r9", nil, "all the previous optimizations plus parallel execution", true, capPerFile | capCheckpoint, r9},
+	{"r10", []string{"swar"}, "all the previous optimizations plus faster semicolon finding and hashing", true,
+		capPerFile | capCheckpoint | capHistograms | capColumns | capFollow | capIncremental, r10},
+	{"window", nil, "r9 extended with a timestamp column to aggregate by time window", true,
+		capHistograms | capWindow, aggregateWindows},
+}
+
+// defaultRevision is the name of the revision that's run by default.
+const defaultRevision = "r10"
+
+func (r *revision) has(c capability) bool {
+	return r.caps&c == c
+}
+
+// missing returns the options needing the capabilities in c that r
+// doesn't have, or "" if it has them all.
+func (r *revision) missing(c capability) string {
+	var options []string
+	for i, info := range capabilities {
+		if c&(1<<i) != 0 && !r.has(1<<i) {
+			options = append(options, info.options)
+		}
+	}
+	return strings.Join(options, ", ")
+}
+
+// findRevision returns the revision with the given name or alias, like
+// "r10" or "swar". For compatibility with the numbered revisions, "10"
+// also works.
+func findRevision(name string) (*revision, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		name = "r" + name
+	}
+	for i := range revisions {
+		if revisions[i].name == name || slices.Contains(revisions[i].aliases, name) {
+			return &revisions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("invalid revision %q (see -list)", name)
+}
+
+// writeRevisions writes the list of revisions for -list.
+func writeRevisions(w io.Writer) {
+	for _, r := range revisions {
+		kind := "serial"
+		if r.parallel {
+			kind = "parallel"
+		}
+		var caps []string
+		for i, info := range capabilities {
+			if r.has(1 << i) {
+				caps = append(caps, info.name)
+			}
+		}
+		fmt.Fprintf(w, "%-6s %-8s %s\n", r.name, kind, r.description)
+		if len(r.aliases) > 0 {
+			fmt.Fprintf(w, "       %-8s aliases: %s\n", "", strings.Join(r.aliases, ", "))
+		}
+		if len(caps) > 0 {
+			fmt.Fprintf(w, "       %-8s supports: %s\n", "", strings.Join(caps, ", "))
+		}
+	}
+}
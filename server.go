@@ -0,0 +1,355 @@
+// HTTP aggregation service: "go-1brc serve" runs the r10 engine over
+// measurements POSTed to /aggregate, and serves live aggregates of readings
+// streamed in over TCP (see live.go) at /stations and /metrics
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		addr        = flags.String("addr", ":8080", "address to listen on")
+		goroutines  = flags.Int("goroutines", 0, "total goroutines shared between requests (default NumCPU)")
+		maxRequests = flags.Int("maxrequests", 4, "maximum number of requests to process at once")
+		maxBytes    = flags.Int64("maxbytes", 1<<30, "maximum (uncompressed) request body size in bytes")
+		tcpAddr     = flags.String("tcp", "", "also accept station;temp lines over TCP on this address")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: go-1brc serve [options]\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	maxGoroutines = *goroutines
+	if maxGoroutines == 0 {
+		maxGoroutines = runtime.NumCPU()
+	}
+
+	handler := newServer(*maxRequests, *maxBytes)
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *tcpAddr != "" {
+		ln, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("accepting readings over TCP on %s", *tcpAddr)
+		go func() {
+			err := serveTCP(ctx, ln, handler.live)
+			if err != nil {
+				log.Printf("TCP ingestion stopped: %v", err)
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("listening on %s", *addr)
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// server is the HTTP handler for serve mode. Each request gets an equal
+// share of maxGoroutines, and requests beyond maxRequests are rejected
+// with 503 Service Unavailable rather than queued.
+type server struct {
+	mux        *http.ServeMux
+	sem        chan struct{}
+	maxBytes   int64
+	goroutines int        // per request
+	live       *liveTable // readings streamed in over TCP
+}
+
+func newServer(maxRequests int, maxBytes int64) *server {
+	s := &server{
+		mux:        http.NewServeMux(),
+		sem:        make(chan struct{}, maxRequests),
+		maxBytes:   maxBytes,
+		goroutines: max(maxGoroutines/maxRequests, 1),
+		live:       newLiveTable(),
+	}
+	s.mux.HandleFunc("/aggregate", s.handleAggregate)
+	s.mux.HandleFunc("/stations", s.handleStations)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleAggregate aggregates the measurements in the request body, which
+// may be gzipped (Content-Encoding: gzip).
+func (s *server) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, s.maxBytes)
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(w, gz, s.maxBytes)
+	default:
+		http.Error(w, "unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	totals, err := aggregateStream(r.Context(), body, s.goroutines)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxErr):
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errTooManyStations):
+			http.Error(w, "too many stations", http.StatusRequestEntityTooLarge)
+		case r.Context().Err() != nil:
+			// Client went away, nobody to respond to.
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	writeResponse(w, r, totals)
+}
+
+// handleStations returns the current aggregates of the readings streamed
+// in over TCP, in the same formats as /aggregate.
+func (s *server) handleStations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeResponse(w, r, s.live.snapshot())
+}
+
+// handleMetrics exposes the live aggregates as Prometheus gauges.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeResults(w, r10Results(s.live.snapshot()), "prometheus")
+}
+
+// writeResponse writes totals in the format given by the "format" query
+// parameter (see writeResults), or as JSON if the Accept header asks for
+// application/json, otherwise in the usual 1BRC text format.
+func writeResponse(w http.ResponseWriter, r *http.Request, totals map[string]*r10Stats) {
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "application/json") {
+		format = "json"
+	}
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	case "", "text":
+		format = "text"
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		http.Error(w, "unknown format "+strconv.Quote(format), http.StatusBadRequest)
+		return
+	}
+	writeResults(w, r10Results(totals), format)
+}
+
+// aggregateStream runs r10's parser over a stream (rather than a file we
+// can split up front) using the given number of worker goroutines. The
+// stream is cut into chunks of complete lines, and each chunk is handed to
+// whichever worker is free, which checks its lines are valid before
+// parsing them. Unlike the file-based revisions, a final line without a
+// trailing newline is included.
+func aggregateStream(ctx context.Context, r io.Reader, workers int) (map[string]*r10Stats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan []byte, workers)
+	type workerResult struct {
+		stats map[string]*r10Stats
+		err   error
+	}
+	resultsCh := make(chan workerResult)
+	for i := 0; i < workers; i++ {
+		go func() {
+			// net/http only recovers panics in the handler's goroutine, so
+			// one here (like a full hash table) would kill the server.
+			defer func() {
+				if r := recover(); r != nil {
+					cancel()
+					err, ok := r.(error)
+					if !ok {
+						err = fmt.Errorf("%v", r)
+					}
+					resultsCh <- workerResult{nil, err}
+				}
+			}()
+			stats, _, err := r10ProcessReader(ctx, &chunkReader{chunks: chunks})
+			if err != nil && ctx.Err() == nil {
+				cancel() // stop the reader and the other workers
+			}
+			resultsCh <- workerResult{stats, err}
+		}()
+	}
+
+	readErr := sendChunks(ctx, r, chunks)
+	close(chunks)
+	if readErr != nil {
+		cancel()
+	}
+
+	// A worker that fails cancels the others and the reader, so report
+	// its error rather than theirs.
+	totals := make(map[string]*r10Stats)
+	var workerErr, cancelErr error
+	for i := 0; i < workers; i++ {
+		result := <-resultsCh
+		switch {
+		case errors.Is(result.err, context.Canceled):
+			cancelErr = result.err
+		case result.err != nil:
+			workerErr = result.err
+		default:
+			r10Merge(totals, result.stats)
+		}
+	}
+	switch {
+	case workerErr != nil:
+		return nil, workerErr
+	case readErr != nil:
+		return nil, readErr
+	case cancelErr != nil:
+		return nil, cancelErr
+	}
+	return totals, nil
+}
+
+// sendChunks reads r and sends it to chunks in pieces that end on a line
+// boundary, carrying any partial line over to the next piece.
+func sendChunks(ctx context.Context, r io.Reader, chunks chan<- []byte) error {
+	const chunkSize = 1024 * 1024
+	var remaining []byte
+	for {
+		buf := make([]byte, len(remaining), chunkSize+len(remaining))
+		copy(buf, remaining)
+		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		atEOF := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !atEOF {
+			return err
+		}
+
+		newline := len(buf) - 1
+		if !atEOF {
+			newline = bytes.LastIndexByte(buf, '\n')
+			if newline < 0 {
+				return errors.New("line too long")
+			}
+		} else if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			buf = append(buf, '\n')
+			newline = len(buf) - 1
+		}
+		remaining = buf[newline+1:]
+
+		if newline >= 0 {
+			select {
+			case chunks <- buf[:newline+1]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if atEOF {
+			return nil
+		}
+	}
+}
+
+// chunkReader is an io.Reader that reads from a sequence of chunks,
+// checking the lines in each (see checkLines) as it's received.
+type chunkReader struct {
+	chunks <-chan []byte
+	cur    []byte
+}
+
+func (c *chunkReader) Read(buf []byte) (int, error) {
+	for len(c.cur) == 0 {
+		chunk, ok := <-c.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		if err := checkLines(chunk); err != nil {
+			return 0, err
+		}
+		c.cur = chunk
+	}
+	n := copy(buf, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// checkLines checks that each line in chunk (which ends with a newline) is
+// a valid "station;temp" reading, as r10's parser assumes its input is.
+func checkLines(chunk []byte) error {
+	for len(chunk) > 0 {
+		newline := bytes.IndexByte(chunk, '\n')
+		line := chunk[:newline]
+		chunk = chunk[newline+1:]
+		station, temp, ok := bytes.Cut(line, []byte{';'})
+		if !ok || len(station) == 0 {
+			return fmt.Errorf("malformed line %q", line)
+		}
+		if _, ok := parseTemp(temp); !ok {
+			return fmt.Errorf("invalid temperature in line %q", line)
+		}
+	}
+	return nil
+}
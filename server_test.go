@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeAggregate(t *testing.T) {
+	maxGoroutines = 4
+	srv := httptest.NewServer(newServer(2, 1<<20))
+	defer srv.Close()
+
+	const body = "Foo;1.0\nBar;-2.5\nFoo;3.0\nBar;10.1" // no final newline
+
+	// More distinct stations than r10's hash table holds.
+	var manyStations strings.Builder
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&manyStations, "s%d;1.0\n", i)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		encoding string
+		body     string
+		status   int
+		want     string
+	}{
+		{"text", "/aggregate", "", body, 200, "{Bar=-2.5/3.8/10.1, Foo=1.0/2.0/3.0}\n"},
+		{"json", "/aggregate?format=json", "", body, 200,
+			`[{"station":"Bar","min":-2.5,"mean":3.8,"max":10.1,"count":2},` +
+				`{"station":"Foo","min":1.0,"mean":2.0,"max":3.0,"count":2}]` + "\n"},
+		{"gzip", "/aggregate", "gzip", body, 200, "{Bar=-2.5/3.8/10.1, Foo=1.0/2.0/3.0}\n"},
+		{"malformed", "/aggregate", "", "Foo;1.0\nhello world\n", 400, "malformed line \"hello world\"\n"},
+		{"bad temperature", "/aggregate", "", "Foo;1.0\nBar;12\n", 400, "invalid temperature in line \"Bar;12\"\n"},
+		{"too many stations", "/aggregate", "", manyStations.String(), 413, "too many stations\n"},
+		{"too large", "/aggregate", "", strings.Repeat("Foo;1.0\n", 1<<18), 413, "request body too large\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var reqBody io.Reader = strings.NewReader(test.body)
+			if test.encoding == "gzip" {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				gz.Write([]byte(test.body))
+				gz.Close()
+				reqBody = &buf
+			}
+			req, err := http.NewRequest("POST", srv.URL+test.url, reqBody)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Encoding", test.encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to POST: %v", err)
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != test.status {
+				t.Errorf("Want status %d, got %d", test.status, resp.StatusCode)
+			}
+			if string(got) != test.want {
+				t.Errorf("Want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
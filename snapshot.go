@@ -0,0 +1,361 @@
+// Aggregate snapshots: a compact binary form of the results that can be
+// written with -snapshot and combined later with "go-1brc merge"
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// snapshotPath is set by -snapshot to also write the final results to a
+// snapshot file.
+var snapshotPath string
+
+// Snapshot format (all integers are varints from encoding/binary, signed
+// ones zig-zag encoded):
+//
+//	magic       "1BRCAGG"
+//	version     uvarint (snapshotVersion)
+//	flags       uvarint (snapshotHasHist if histograms are present,
+//	            snapshotHasWindows if aggregated by time window,
+//	            snapshotHasColumns if there are extra value columns)
+//	if snapshotHasWindows:
+//	    window size uvarint (seconds)
+//	if snapshotHasColumns:
+//	    numColumns uvarint (including the first)
+//	    numColumns times: name uvarint length, then bytes
+//	numStations uvarint
+//	numStations times:
+//	    name      uvarint length, then bytes
+//	    if snapshotHasWindows:
+//	        window start varint (Unix seconds)
+//	    min, max  varint (tenths of a degree)
+//	    sum       varint (tenths of a degree)
+//	    count     uvarint
+//	    if snapshotHasColumns:
+//	        numColumns-1 times: min, max, sum varint (tenths)
+//	    if snapshotHasHist:
+//	        numBuckets uvarint
+//	        numBuckets times: temp varint (tenths), count uvarint
+//	crc32       4 bytes little endian, IEEE checksum of everything before
+const (
+	snapshotMagic      = "1BRCAGG"
+	snapshotVersion    = 1
+	snapshotHasHist    = 1 << 0
+	snapshotHasWindows = 1 << 1
+	snapshotHasColumns = 1 << 2
+)
+
+func encodeSnapshot(w io.Writer, results []stationResult) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var flags uint64
+	for _, r := range results {
+		if r.hist != nil {
+			flags |= snapshotHasHist
+			break
+		}
+	}
+	if windowSize != 0 {
+		flags |= snapshotHasWindows
+	}
+	if len(valueColumns) > 1 {
+		flags |= snapshotHasColumns
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		bw.Write(buf[:n])
+	}
+	putVarint := func(v int64) {
+		n := binary.PutVarint(buf, v)
+		bw.Write(buf[:n])
+	}
+
+	bw.WriteString(snapshotMagic)
+	putUvarint(snapshotVersion)
+	putUvarint(flags)
+	if flags&snapshotHasWindows != 0 {
+		putUvarint(uint64(windowSize / time.Second))
+	}
+	if flags&snapshotHasColumns != 0 {
+		putUvarint(uint64(len(valueColumns)))
+		for _, name := range valueColumns {
+			putUvarint(uint64(len(name)))
+			bw.WriteString(name)
+		}
+	}
+	putUvarint(uint64(len(results)))
+	for _, r := range results {
+		putUvarint(uint64(len(r.station)))
+		bw.WriteString(r.station)
+		if flags&snapshotHasWindows != 0 {
+			putVarint(r.window)
+		}
+		putVarint(int64(r.min))
+		putVarint(int64(r.max))
+		putVarint(r.sum)
+		putUvarint(uint64(r.count))
+		if flags&snapshotHasColumns != 0 {
+			for i := 0; i < len(valueColumns)-1; i++ {
+				var c columnStats
+				if i < len(r.cols) {
+					c = r.cols[i]
+				}
+				putVarint(int64(c.min))
+				putVarint(int64(c.max))
+				putVarint(c.sum)
+			}
+		}
+		if flags&snapshotHasHist != 0 {
+			temps := make([]int32, 0, len(r.hist))
+			for temp := range r.hist {
+				temps = append(temps, temp)
+			}
+			slices.Sort(temps)
+			putUvarint(uint64(len(temps)))
+			for _, temp := range temps {
+				putVarint(int64(temp))
+				putUvarint(uint64(r.hist[temp]))
+			}
+		}
+	}
+	err := bw.Flush()
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// snapshotLayout is how the results in a snapshot were aggregated, which
+// must be the same for snapshots to be merged.
+type snapshotLayout struct {
+	window  time.Duration // window size, or 0 if not aggregated by window
+	columns []string      // value column names, if there's more than one
+}
+
+func (l snapshotLayout) String() string {
+	s := "no windows"
+	if l.window != 0 {
+		s = fmt.Sprintf("%v windows", l.window)
+	}
+	if l.columns != nil {
+		s += fmt.Sprintf(" and columns %v", l.columns)
+	}
+	return s
+}
+
+// decodeSnapshot decodes the snapshot in data, which is small enough to
+// read into memory in full, so we can check the checksum up front. It
+// also returns the snapshot's layout, which callers that don't know it
+// already must check before merging the results.
+func decodeSnapshot(data []byte) ([]stationResult, snapshotLayout, error) {
+	var layout snapshotLayout
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, layout, errors.New("not a snapshot file")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, layout, errors.New("invalid snapshot: checksum mismatch")
+	}
+	br := bytes.NewReader(body[len(snapshotMagic):])
+
+	var decodeErr error
+	uvarint := func() uint64 {
+		v, err := binary.ReadUvarint(br)
+		if err != nil && decodeErr == nil {
+			decodeErr = err
+		}
+		return v
+	}
+	varint := func() int64 {
+		v, err := binary.ReadVarint(br)
+		if err != nil && decodeErr == nil {
+			decodeErr = err
+		}
+		return v
+	}
+
+	version := uvarint()
+	if decodeErr == nil && version != snapshotVersion {
+		return nil, layout, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	flags := uvarint()
+	if flags&^(snapshotHasHist|snapshotHasWindows|snapshotHasColumns) != 0 {
+		return nil, layout, fmt.Errorf("unsupported snapshot flags %#x", flags)
+	}
+	if flags&snapshotHasWindows != 0 {
+		layout.window = time.Duration(uvarint()) * time.Second
+	}
+	var numColumns int
+	if flags&snapshotHasColumns != 0 {
+		numColumns = int(uvarint())
+		for i := 0; i < numColumns && decodeErr == nil; i++ {
+			nameLen := uvarint()
+			if nameLen > uint64(br.Len()) {
+				return nil, layout, errors.New("invalid snapshot: column name too long")
+			}
+			name := make([]byte, nameLen)
+			br.Read(name)
+			layout.columns = append(layout.columns, string(name))
+		}
+	}
+	numStations := uvarint()
+
+	var results []stationResult
+	for i := uint64(0); i < numStations && decodeErr == nil; i++ {
+		nameLen := uvarint()
+		if nameLen > uint64(br.Len()) {
+			return nil, layout, errors.New("invalid snapshot: station name too long")
+		}
+		name := make([]byte, nameLen)
+		br.Read(name)
+		var window int64
+		if flags&snapshotHasWindows != 0 {
+			window = varint()
+		}
+		r := stationResult{
+			station: string(name),
+			window:  window,
+			min:     int32(varint()),
+			max:     int32(varint()),
+			sum:     varint(),
+			count:   int64(uvarint()),
+		}
+		for j := 1; j < numColumns && decodeErr == nil; j++ {
+			r.cols = append(r.cols, columnStats{int32(varint()), int32(varint()), varint()})
+		}
+		if flags&snapshotHasHist != 0 {
+			numBuckets := uvarint()
+			r.hist = make(map[int32]int64)
+			for j := uint64(0); j < numBuckets && decodeErr == nil; j++ {
+				temp := int32(varint())
+				r.hist[temp] += int64(uvarint())
+			}
+		}
+		results = append(results, r)
+	}
+	if decodeErr != nil {
+		return nil, layout, fmt.Errorf("invalid snapshot: %w", decodeErr)
+	}
+	if br.Len() != 0 {
+		return nil, layout, errors.New("invalid snapshot: trailing data")
+	}
+	return results, layout, nil
+}
+
+func readSnapshot(path string) ([]stationResult, snapshotLayout, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, snapshotLayout{}, err
+	}
+	results, layout, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, layout, fmt.Errorf("%s: %w", path, err)
+	}
+	return results, layout, nil
+}
+
+// mergeResults adds results into totals, combining the stats of stations
+// that are already present.
+func mergeResults(totals map[string]*stationResult, results []stationResult) {
+	for _, r := range results {
+		t := totals[r.key()]
+		if t == nil {
+			c := r
+			c.cols = mergeColumns(nil, r.cols)
+			if r.hist != nil {
+				c.hist = make(map[int32]int64, len(r.hist))
+				for temp, n := range r.hist {
+					c.hist[temp] = n
+				}
+			}
+			totals[r.key()] = &c
+			continue
+		}
+		t.min = min(t.min, r.min)
+		t.max = max(t.max, r.max)
+		t.sum += r.sum
+		t.count += r.count
+		if r.cols != nil {
+			t.cols = mergeColumns(t.cols, r.cols)
+		}
+		if r.hist != nil {
+			if t.hist == nil {
+				t.hist = make(map[int32]int64, len(r.hist))
+			}
+			for temp, n := range r.hist {
+				t.hist[temp] += n
+			}
+		}
+	}
+}
+
+// resultsSlice converts the totals built by mergeResults back to a slice.
+func resultsSlice(totals map[string]*stationResult) []stationResult {
+	results := make([]stationResult, 0, len(totals))
+	for _, r := range totals {
+		results = append(results, *r)
+	}
+	return results
+}
+
+// runMerge implements "go-1brc merge": it combines snapshot files written
+// with -snapshot (for example on different machines) into a final result.
+func runMerge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	var (
+		format   = flags.String("format", "text", "output format: "+strings.Join(outputFormats, ", "))
+		snapshot = flags.String("snapshot", "", "also write the merged results to this snapshot file")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: go-1brc merge [options] SNAPSHOT...\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if !slices.Contains(outputFormats, *format) {
+		return fmt.Errorf("invalid format %q", *format)
+	}
+	outputFormat = *format
+	snapshotPath = *snapshot
+
+	// Results can only be merged with others aggregated the same way. The
+	// first snapshot's layout is used for the output (and for the keys
+	// that mergeResults merges by).
+	totals := make(map[string]*stationResult)
+	var first snapshotLayout
+	for i, path := range flags.Args() {
+		results, layout, err := readSnapshot(path)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = layout
+			windowSize, valueColumns = layout.window, layout.columns
+		} else if layout.window != first.window || !slices.Equal(layout.columns, first.columns) {
+			return fmt.Errorf("%s has %v but %s has %v", path, layout, flags.Arg(0), first)
+		}
+		mergeResults(totals, results)
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+	return outputResults(output, resultsSlice(totals))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	results := []stationResult{
+		{station: "Hamburg", min: -53, max: 412, sum: 1234, count: 3,
+			hist: map[int32]int64{-53: 1, 412: 1, 875: 1}},
+		{station: "São Paulo", min: 0, max: 0, sum: 0, count: 1},
+	}
+	var buf bytes.Buffer
+	err := encodeSnapshot(&buf, results)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+
+	got, layout, err := decodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if layout.window != 0 || layout.columns != nil {
+		t.Errorf("Want no windows or columns, got %v", layout)
+	}
+	results[1].hist = map[int32]int64{} // present but empty once any station has one
+	if !reflect.DeepEqual(got, results) {
+		t.Errorf("Want %+v, got %+v", results, got)
+	}
+
+	data[len(data)/2] ^= 1
+	_, _, err = decodeSnapshot(data)
+	if err == nil {
+		t.Errorf("Want error decoding corrupted snapshot, got nil")
+	}
+}
+
+func TestSnapshotLayout(t *testing.T) {
+	windowSize, valueColumns = time.Hour, []string{"temp", "humidity"}
+	results := []stationResult{
+		{station: "Hamburg", window: 3600, min: 1, max: 2, sum: 3, count: 2,
+			cols: []columnStats{{min: 50, max: 60, sum: 110}}},
+	}
+	var buf bytes.Buffer
+	err := encodeSnapshot(&buf, results)
+	windowSize, valueColumns = 0, nil
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	got, layout, err := decodeSnapshot(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, results) {
+		t.Errorf("Want %+v, got %+v", results, got)
+	}
+	want := snapshotLayout{time.Hour, []string{"temp", "humidity"}}
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("Want layout %v, got %v", want, layout)
+	}
+	if windowSize != 0 || valueColumns != nil {
+		t.Errorf("Want -window and -columns unchanged, got %v and %v", windowSize, valueColumns)
+	}
+}
@@ -0,0 +1,109 @@
+// Output order: -sort orders the results by name or by a value, -desc
+// reverses it, and -collate compares names using a locale's collation
+// rather than byte order
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// sortBy, sortDesc and sortCollator are set by -sort, -desc and -collate.
+// If sortCollator is nil, names are compared in byte order.
+var (
+	sortBy       = "name"
+	sortDesc     bool
+	sortCollator *collate.Collator
+)
+
+var sortFields = []string{"name", "mean", "max", "min", "count"}
+
+// newCollator returns a collator for the given BCP 47 locale, like "de"
+// or "sv-SE".
+func newCollator(locale string) (*collate.Collator, error) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -collate locale %q: %v", locale, err)
+	}
+	return collate.New(tag), nil
+}
+
+// nameKeys returns a key for each name that compares (with bytes.Compare)
+// the way the names should be ordered. Computing the collation keys once
+// per name is much cheaper than collating on every comparison.
+func nameKeys(names []string) [][]byte {
+	keys := make([][]byte, len(names))
+	if sortCollator == nil {
+		for i, name := range names {
+			keys[i] = []byte(name)
+		}
+		return keys
+	}
+	var buf collate.Buffer
+	for i, name := range names {
+		keys[i] = bytes.Clone(sortCollator.KeyFromString(&buf, name))
+		buf.Reset()
+	}
+	return keys
+}
+
+// sortNames sorts names in place as for nameKeys.
+func sortNames(names []string) {
+	keys := nameKeys(names)
+	sort.Sort(byKey{names, keys})
+}
+
+type byKey struct {
+	names []string
+	keys  [][]byte
+}
+
+func (s byKey) Len() int           { return len(s.names) }
+func (s byKey) Less(i, j int) bool { return bytes.Compare(s.keys[i], s.keys[j]) < 0 }
+func (s byKey) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// sortResults returns a sorted copy of results, ordered by sortBy and
+// reversed if sortDesc is true. Stations with equal values are ordered by name, and time windows
+// of the same station by start time (both ascending).
+func sortResults(results []stationResult) []stationResult {
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = r.station
+	}
+	keys := nameKeys(names)
+
+	order := make([]int, len(results))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		ra, rb := results[order[a]], results[order[b]]
+		if sortBy != "name" {
+			va, vb := rankValue(ra, sortBy), rankValue(rb, sortBy)
+			if va != vb {
+				return (va < vb) != sortDesc
+			}
+		}
+		if c := bytes.Compare(keys[order[a]], keys[order[b]]); c != 0 {
+			return (c < 0) != (sortDesc && sortBy == "name")
+		}
+		if ra.station != rb.station {
+			return ra.station < rb.station // equal under collation
+		}
+		return ra.window < rb.window
+	})
+
+	sorted := make([]stationResult, len(results))
+	for i, j := range order {
+		sorted[i] = results[j]
+	}
+	return sorted
+}
@@ -0,0 +1,103 @@
+// Per-phase timing breakdown, printed to stderr with -timings
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type phase int
+
+const (
+	phaseSplit phase = iota
+	phaseParse
+	phaseMerge
+	phaseSort
+	phaseFormat
+)
+
+// phaseTimings accumulates the time spent in each phase of a single run.
+// Parse times are recorded per worker so we can see the skew between the
+// fastest and slowest goroutine; other phases are summed.
+type phaseTimings struct {
+	mu       sync.Mutex
+	split    time.Duration
+	parse    []time.Duration
+	merge    time.Duration
+	sort     time.Duration
+	format   time.Duration
+	rows     int64
+	stations int
+}
+
+var timings phaseTimings
+
+func (t *phaseTimings) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.split = 0
+	t.parse = t.parse[:0]
+	t.merge = 0
+	t.sort = 0
+	t.format = 0
+	t.rows = 0
+	t.stations = 0
+}
+
+// record adds the time since start to the given phase and returns the
+// current time, so that consecutive phases can be chained.
+func (t *phaseTimings) record(p phase, start time.Time) time.Time {
+	now := time.Now()
+	elapsed := now.Sub(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch p {
+	case phaseSplit:
+		t.split += elapsed
+	case phaseParse:
+		t.parse = append(t.parse, elapsed)
+	case phaseMerge:
+		t.merge += elapsed
+	case phaseSort:
+		t.sort += elapsed
+	case phaseFormat:
+		t.format += elapsed
+	}
+	return now
+}
+
+func (t *phaseTimings) count(rows int64, stations int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rows += rows
+	t.stations += stations
+}
+
+func (t *phaseTimings) print(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(w, "  split:    %v\n", t.split)
+	switch len(t.parse) {
+	case 0:
+	case 1:
+		fmt.Fprintf(w, "  parse:    %v\n", t.parse[0])
+	default:
+		minParse, maxParse := t.parse[0], t.parse[0]
+		for _, d := range t.parse[1:] {
+			minParse = min(minParse, d)
+			maxParse = max(maxParse, d)
+		}
+		skew := float64(maxParse) / float64(max(minParse, 1))
+		fmt.Fprintf(w, "  parse:    %v (%d workers: min %v, max %v, skew %.2fx)\n",
+			maxParse, len(t.parse), minParse, maxParse, skew)
+	}
+	fmt.Fprintf(w, "  merge:    %v\n", t.merge)
+	fmt.Fprintf(w, "  sort:     %v\n", t.sort)
+	fmt.Fprintf(w, "  format:   %v\n", t.format)
+	fmt.Fprintf(w, "  rows:     %d\n", t.rows)
+	fmt.Fprintf(w, "  stations: %d\n", t.stations)
+}
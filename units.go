@@ -0,0 +1,67 @@
+// Unit conversion: -unit=F or -unit=K converts temperatures when they're
+// output, leaving the fixed point Celsius tenths used everywhere else alone
+
+package main
+
+import (
+	"strconv"
+)
+
+// outputUnit is set by -unit.
+var outputUnit = "C"
+
+var outputUnits = []string{"C", "F", "K"}
+
+// unitConversion converts t tenths of a degree Celsius to (a*t + b) / d
+// tenths in another unit. These are exact, so the only rounding is when
+// formatting the final value.
+type unitConversion struct {
+	a, b, d int64
+}
+
+var unitConversions = map[string]unitConversion{
+	"C": {1, 0, 1},
+	"F": {9, 1600, 5}, // F = C*9/5 + 32
+	"K": {2, 5463, 2}, // K = C + 273.15
+}
+
+// convertTemp returns the mean of count readings that add up to sum
+// tenths of a degree Celsius (just a single reading if count is 1), in
+// tenths of outputUnit, as the exact fraction num/den.
+func convertTemp(sum, count int64) (num, den int64) {
+	u := unitConversions[outputUnit]
+	return u.a*sum + u.b*count, u.d * count
+}
+
+// formatTemp formats a temperature as for convertTemp, to one decimal
+// place. Celsius values are formatted exactly as before there were other
+// units; converted values are rounded to the nearest tenth, with halves
+// rounded up.
+func formatTemp(sum, count int64) string {
+	if outputUnit == "C" {
+		return strconv.FormatFloat(float64(sum)/float64(count)/10, 'f', 1, 64)
+	}
+	num, den := convertTemp(sum, count)
+	tenths := floorDiv(2*num+den, 2*den)
+	sign := ""
+	if tenths < 0 {
+		sign = "-"
+		tenths = -tenths
+	}
+	return sign + strconv.FormatInt(tenths/10, 10) + "." + strconv.FormatInt(tenths%10, 10)
+}
+
+// tempValue returns a temperature as for convertTemp as a float64.
+func tempValue(sum, count int64) float64 {
+	num, den := convertTemp(sum, count)
+	return float64(num) / float64(den) / 10
+}
+
+// floorDiv returns a/b rounded down, for b > 0.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,83 @@
+// Invalid UTF-8: -invalidutf8 sets what to do with station names that
+// aren't valid UTF-8, which the fast paths otherwise treat as raw bytes
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// invalidUTF8 is set by -invalidutf8 to one of invalidUTF8Policies, or ""
+// to leave invalid names as they are.
+var invalidUTF8 string
+
+var invalidUTF8Policies = []string{"reject", "replace", "hex-escape"}
+
+// invalidNames records the distinct station names that weren't valid
+// UTF-8, for the summary. Names are added as they're inserted into the
+// workers' hash tables, so it's shared and needs a lock.
+var invalidNames struct {
+	sync.Mutex
+	names map[string]struct{}
+}
+
+// fixUTF8 applies the -invalidutf8 policy to a station name. It returns
+// the name to use, or ok false if the station should be dropped.
+func fixUTF8(station string) (name string, ok bool) {
+	if invalidUTF8 == "" || utf8.ValidString(station) {
+		return station, true
+	}
+	invalidNames.Lock()
+	if invalidNames.names == nil {
+		invalidNames.names = make(map[string]struct{})
+	}
+	invalidNames.names[station] = struct{}{}
+	invalidNames.Unlock()
+
+	switch invalidUTF8 {
+	case "replace":
+		return strings.ToValidUTF8(station, "\uFFFD"), true
+	case "hex-escape":
+		return hexEscape(station), true
+	default: // "reject"
+		return "", false
+	}
+}
+
+// hexEscape returns s with each byte that isn't part of a valid UTF-8
+// sequence replaced by \xNN. Existing backslashes aren't escaped, so it
+// can't always be reversed, but the result is valid and readable.
+func hexEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// writeInvalidNames reports how many stations had invalid UTF-8 names and
+// what was done with them.
+func writeInvalidNames(w io.Writer) {
+	invalidNames.Lock()
+	n := len(invalidNames.names)
+	invalidNames.Unlock()
+	if n == 0 {
+		return
+	}
+	action := map[string]string{
+		"reject":     "dropped",
+		"replace":    "replaced invalid bytes with U+FFFD",
+		"hex-escape": "hex-escaped invalid bytes",
+	}[invalidUTF8]
+	fmt.Fprintf(w, "Found %d station names with invalid UTF-8 (%s)\n", n, action)
+}
@@ -0,0 +1,365 @@
+// Time windows: with -window, each line starts with a timestamp column
+// (timestamp;station;temp) and stats are aggregated per station per window
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// windowSize is set by -window. If it's non-zero, the input has a
+// timestamp column and readings are aggregated per station per window of
+// this size (aligned to the Unix epoch, so daily windows start at
+// midnight UTC).
+var windowSize time.Duration
+
+// parseWindow parses a -window size: a Go duration like "1h" or "15m", or
+// a number of days like "1d".
+func parseWindow(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid -window %q: must be a whole number of seconds, like 1h or 1d", s)
+	}
+	return d, nil
+}
+
+// windowStats are the stats for one station in one window.
+type windowStats struct {
+	station string
+	window  int64 // start of the window in Unix seconds
+	r10Stats
+}
+
+// windowMapKey returns the key used for a station and window in the maps
+// of windowStats.
+func windowMapKey(station []byte, window int64) string {
+	key := make([]byte, len(station)+8)
+	copy(key, station)
+	binary.LittleEndian.PutUint64(key[len(station):], uint64(window))
+	return string(key)
+}
+
+// aggregateWindows is used instead of the selected revision when -window
+// is set. It splits and merges like r9, with r9's worker loop extended to
+// parse the timestamp and key its hash table by (station, window).
+func aggregateWindows(ctx context.Context, inputPaths []string, output io.Writer) error {
+	mark := time.Now()
+	parts, err := splitFiles(inputPaths, maxGoroutines)
+	if err != nil {
+		return err
+	}
+	timings.record(phaseSplit, mark)
+
+	resultsCh := make(chan partResult[*windowStats])
+	errorsCh := make(chan error, len(parts))
+	runParts(parts, func(p part) {
+		err := windowProcessPart(ctx, p.path, p.offset, p.size, resultsCh)
+		errorsCh <- err
+	})
+
+	var covered []byteRange
+	stopped := false
+	totals := make(map[string]*windowStats)
+	for i := 0; i < len(parts); i++ {
+		result := <-resultsCh
+		mergeStart := time.Now()
+		covered = append(covered, result.covered)
+		stopped = stopped || result.stopped
+		for key, s := range result.stats {
+			ts := totals[key]
+			if ts == nil {
+				totals[key] = s
+				continue
+			}
+			ts.merge(&s.r10Stats)
+		}
+		timings.record(phaseMerge, mergeStart)
+	}
+	for range parts {
+		if err := <-errorsCh; err != nil {
+			return err
+		}
+	}
+
+	results := make([]stationResult, 0, len(totals))
+	for _, s := range totals {
+		results = append(results, stationResult{
+			station: s.station,
+			window:  s.window,
+			min:     s.min,
+			max:     s.max,
+			sum:     s.sum,
+			count:   s.count,
+			hist:    histMap(s.hist),
+		})
+	}
+	err = outputResults(output, results)
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return &incompleteError{ctx.Err(), covered}
+	}
+	return nil
+}
+
+// parseTimestamp parses an RFC 3339 timestamp or a Unix epoch time in
+// seconds (possibly with a fractional part), and returns the start of its
+// window in Unix seconds.
+func parseTimestamp(b []byte, windowSecs int64) (int64, error) {
+	var secs int64
+	if isEpoch(b) {
+		f, err := strconv.ParseFloat(string(b), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", b)
+		}
+		secs = int64(math.Floor(f))
+	} else {
+		t, err := time.Parse(time.RFC3339Nano, string(b))
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", b)
+		}
+		secs = t.Unix()
+	}
+	window := secs / windowSecs * windowSecs
+	if window > secs {
+		window -= windowSecs // round negative times down too
+	}
+	return window, nil
+}
+
+// isEpoch reports whether b looks like an epoch time rather than RFC 3339
+// (which always has a '-' after the year).
+func isEpoch(b []byte) bool {
+	if len(b) > 0 && b[0] == '-' {
+		b = b[1:]
+	}
+	for _, c := range b {
+		if (c < '0' || c > '9') && c != '.' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+func windowProcessPart(ctx context.Context, inputPath string, fileOffset, fileSize int64, resultsCh chan partResult[*windowStats]) error {
+	start := time.Now()
+	f, err := openPart(inputPath, fileOffset, fileSize)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	type item struct {
+		key    []byte
+		window int64
+		hash   uint64 // of key and window, for growing the table
+		stat   *r10Stats
+		name   string // stationName(key)
+		skip   bool   // station is rejected or doesn't pass stationFilter
+	}
+	// Unlike r9's table, this one grows: there's a key for every station in
+	// every window, so even ordinary input can have millions.
+	numBuckets := 1 << 17             // number of hash buckets (power of 2)
+	items := make([]item, numBuckets) // hash buckets, linearly probed
+	size := 0                         // number of active items in items slice
+	grow := func() {
+		old := items
+		numBuckets *= 2
+		items = make([]item, numBuckets)
+		for _, it := range old {
+			if it.key == nil {
+				continue
+			}
+			i := int(it.hash & uint64(numBuckets-1))
+			for items[i].key != nil {
+				i = (i + 1) & (numBuckets - 1)
+			}
+			items[i] = it
+		}
+	}
+
+	windowSecs := int64(windowSize / time.Second)
+	var lastTimestamp []byte // consecutive lines often have the same timestamp
+	var window int64
+
+	var processed int64
+	stopped := false
+	var parseErr error
+	buf := make([]byte, 1024*1024)
+	readStart := 0
+	for parseErr == nil {
+		n, err := f.Read(buf[readStart:])
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		if readStart+n == 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			stopped = true
+			break
+		}
+		chunk := buf[:readStart+n]
+
+		newline := bytes.LastIndexByte(chunk, '\n')
+		if newline < 0 {
+			break
+		}
+		remaining := chunk[newline+1:]
+		chunk = chunk[:newline+1]
+		processed += int64(len(chunk))
+
+		for len(chunk) > 0 {
+			const (
+				// FNV-1 64-bit constants from hash/fnv.
+				offset64 = 14695981039346656037
+				prime64  = 1099511628211
+			)
+
+			semi := bytes.IndexByte(chunk, ';')
+			if semi < 0 {
+				parseErr = fmt.Errorf("missing timestamp column at offset %d", fileOffset+processed-int64(len(chunk)))
+				break
+			}
+			timestamp := chunk[:semi]
+			if !bytes.Equal(timestamp, lastTimestamp) {
+				window, parseErr = parseTimestamp(timestamp, windowSecs)
+				if parseErr != nil {
+					break
+				}
+				lastTimestamp = append(lastTimestamp[:0], timestamp...)
+			}
+			chunk = chunk[semi+1:]
+
+			var station, after []byte
+			hash := uint64(offset64)
+			i := 0
+			for ; i < len(chunk); i++ {
+				c := chunk[i]
+				if c == ';' {
+					station = chunk[:i]
+					after = chunk[i+1:]
+					break
+				}
+				hash ^= uint64(c) // FNV-1a is XOR then *
+				hash *= prime64
+			}
+			if i == len(chunk) {
+				parseErr = fmt.Errorf("missing temperature column at offset %d", fileOffset+processed-int64(len(chunk)))
+				break
+			}
+			hash ^= uint64(window)
+			hash *= prime64
+
+			index := 0
+			negative := false
+			if after[index] == '-' {
+				negative = true
+				index++
+			}
+			temp := int32(after[index] - '0')
+			index++
+			if after[index] != '.' {
+				temp = temp*10 + int32(after[index]-'0')
+				index++
+			}
+			index++ // skip '.'
+			temp = temp*10 + int32(after[index]-'0')
+			index += 2 // skip last digit and '\n'
+			if negative {
+				temp = -temp
+			}
+			chunk = after[index:]
+
+			hashIndex := int(hash & uint64(numBuckets-1))
+			for {
+				if items[hashIndex].key == nil {
+					// Found empty slot, add new item (copying key).
+					key := make([]byte, len(station))
+					copy(key, station)
+					name, ok := stationName(key)
+					if !ok || (stationFilter != nil && !stationFilter(name)) {
+						items[hashIndex] = item{key: key, window: window, hash: hash, name: name, skip: true}
+					} else {
+						items[hashIndex] = item{
+							key:    key,
+							window: window,
+							hash:   hash,
+							name:   name,
+							stat: &r10Stats{
+								min:   temp,
+								max:   temp,
+								sum:   int64(temp),
+								count: 1,
+							},
+						}
+						if collectHist {
+							items[hashIndex].stat.hist = make([]int64, histSize)
+							items[hashIndex].stat.hist[temp+histOffset]++
+						}
+					}
+					size++
+					if size > numBuckets/2 {
+						grow()
+					}
+					break
+				}
+				if items[hashIndex].window == window && bytes.Equal(items[hashIndex].key, station) {
+					// Found matching slot, add to existing stats.
+					if items[hashIndex].skip {
+						break
+					}
+					s := items[hashIndex].stat
+					s.min = min(s.min, temp)
+					s.max = max(s.max, temp)
+					s.sum += int64(temp)
+					s.count++
+					if s.hist != nil {
+						s.hist[temp+histOffset]++
+					}
+					break
+				}
+				// Slot already holds another key, try next slot (linear probe).
+				hashIndex++
+				if hashIndex >= numBuckets {
+					hashIndex = 0
+				}
+			}
+		}
+
+		readStart = copy(buf, remaining)
+	}
+
+	result := make(map[string]*windowStats, size)
+	for _, item := range items {
+		if item.key == nil || item.skip {
+			continue
+		}
+		key := windowMapKey([]byte(item.name), item.window)
+		if s := result[key]; s != nil {
+			s.merge(item.stat) // another key normalized to the same name
+			continue
+		}
+		result[key] = &windowStats{item.name, item.window, *item.stat}
+	}
+	timings.record(phaseParse, start)
+	resultsCh <- partResult[*windowStats]{result, byteRange{inputPath, fileOffset, f.end(processed)}, stopped}
+	return parseErr
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAggregateWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "windows.txt")
+	input := "2024-01-01T00:10:00Z;Foo;1.0\n" +
+		"2024-01-01T00:20:00Z;Bar;2.0\n" +
+		"2024-01-01T01:05:00Z;Foo;3.0\n" +
+		"2024-01-01T00:30:00Z;Foo;5.0\n"
+	err := os.WriteFile(path, []byte(input), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+
+	windowSize = time.Hour
+	maxGoroutines = 2
+	defer func() { windowSize, maxGoroutines = 0, 0 }()
+	var output bytes.Buffer
+	err = aggregateWindows(context.Background(), []string{path}, &output)
+	if err != nil {
+		t.Fatalf("Failed to aggregate %s: %v", path, err)
+	}
+	want := "{Bar@2024-01-01T00:00:00Z=2.0/2.0/2.0, Foo@2024-01-01T00:00:00Z=1.0/3.0/5.0, Foo@2024-01-01T01:00:00Z=3.0/3.0/3.0}\n"
+	if output.String() != want {
+		t.Errorf("Want %q, got %q", want, output.String())
+	}
+}
+
+func TestWindowProcessPartGrows(t *testing.T) {
+	// 10 stations with a reading every hour for 7000 hours is 70,000
+	// (station, window) keys, more than fit in the initial hash table.
+	const stations, hours = 10, 7000
+	var input bytes.Buffer
+	for h := 0; h < hours; h++ {
+		for s := 0; s < stations; s++ {
+			fmt.Fprintf(&input, "%d;s%d;%d.5\n", h*3600+1800, s, s)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "hourly.txt")
+	err := os.WriteFile(path, input.Bytes(), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+
+	windowSize = time.Hour
+	defer func() { windowSize = 0 }()
+	resultsCh := make(chan partResult[*windowStats], 1)
+	err = windowProcessPart(context.Background(), path, 0, int64(input.Len()), resultsCh)
+	if err != nil {
+		t.Fatalf("Failed to process %s: %v", path, err)
+	}
+	result := <-resultsCh
+	if len(result.stats) != stations*hours {
+		t.Fatalf("Want %d keys, got %d", stations*hours, len(result.stats))
+	}
+	s := result.stats[windowMapKey([]byte("s3"), 6999*3600)]
+	if s == nil || s.count != 1 || s.min != 35 {
+		t.Errorf("Want s3 in the last window with one reading of 3.5, got %+v", s)
+	}
+}